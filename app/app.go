@@ -0,0 +1,499 @@
+// Package app wires the configured components into a running NRDP server: storage,
+// database, result sinks, ingest queue, Nagios config generator, metrics, health
+// endpoints and the HTTP server itself.
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/config"
+	"nrdp_micro/db"
+	"nrdp_micro/extcmd"
+	"nrdp_micro/health"
+	"nrdp_micro/logger"
+	"nrdp_micro/metrics"
+	"nrdp_micro/nagios_config"
+	"nrdp_micro/queue"
+	"nrdp_micro/storage"
+	"nrdp_micro/tlsutil"
+)
+
+// Version is reported to clients in the NRDP hello response
+const Version = "1.0.0"
+
+// Options configures a Server. Only Config is required; the other fields replace the
+// components the Server would otherwise build from the configuration, so the receiver
+// can be embedded in another Go service.
+type Options struct {
+	Config config.Config // Validated by NewServer
+
+	// Listen makes Start also serve HTTP(S) on Config.Server.ListenAddr. Leave it false
+	// to mount the Server as an http.Handler in an existing HTTP server.
+	Listen bool
+
+	// Logger receives the log output at Config.Logging.Level, nil keeps the current one.
+	// Logging is process-wide, so this applies to every Server in the process.
+	Logger logger.Printer
+
+	// Sinks replaces the sinks listed in storage.sinks. The Server closes them on Stop.
+	// With the ingest queue enabled they receive results from the queue drainer.
+	Sinks []check.Sink
+
+	// Store replaces the SQLite database at Config.DatabasePath. The Server closes it on Stop.
+	Store db.Store
+
+	// Clock supplies the time for last-seen timestamps, stale cutoffs and rate limits,
+	// time.Now when nil.
+	Clock func() time.Time
+
+	// DisableNagiosConfig skips generating Nagios object config and running the reload
+	// command, so nagios.output_dir need not exist.
+	DisableNagiosConfig bool
+}
+
+// Server is a configured NRDP receiver. It serves the NRDP, health and metrics endpoints
+// as an http.Handler; Start starts its background components and, with Options.Listen,
+// its own HTTP server, and Stop shuts everything down again.
+type Server struct {
+	cfg    config.Config
+	listen bool
+	sinks  []check.Sink
+	now    func() time.Time
+
+	storage   *storage.Manager
+	db        db.Store
+	commands  *extcmd.Writer
+	handler   *Handler
+	generator *nagios_config.Generator
+	registry  *metrics.Registry
+	mux       *http.ServeMux
+
+	// Durable ingest queue, its drainer and the processor it delivers to, nil when the queue is disabled
+	ingestQueue       *queue.Queue
+	queueDrainer      *queue.Drainer
+	deliveryProcessor *check.Processor
+
+	httpServer   *http.Server
+	certReloader *tlsutil.CertReloader // nil without TLS
+	listener     net.Listener
+	stopMonitor  func()
+	serveErr     chan error
+	started      bool
+}
+
+// New builds the standalone server from a configuration, listening on server.listen_addr
+// once started.
+func New(cfg config.Config) (*Server, error) {
+	return NewServer(Options{Config: cfg, Listen: true})
+}
+
+// NewServer validates the configuration and builds a server from it and the given hooks.
+// Nothing is served and no background goroutine runs until Start is called. The Server
+// owns the supplied Store and Sinks from here on: on error they are closed together with
+// every resource opened so far.
+func NewServer(opts Options) (*Server, error) {
+	cfg := opts.Config
+	s := &Server{
+		cfg:      cfg,
+		listen:   opts.Listen,
+		sinks:    opts.Sinks,
+		db:       opts.Store,
+		now:      opts.Clock,
+		registry: metrics.NewRegistry(),
+		mux:      http.NewServeMux(),
+		serveErr: make(chan error, 1),
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+
+	// Directories are only checked for the components that are not replaced by the options
+	used := config.Components{
+		Spool:        opts.Sinks == nil && slices.Contains(cfg.Storage.Sinks, "spool"),
+		Database:     opts.Store == nil,
+		NagiosConfig: !opts.DisableNagiosConfig,
+	}
+	if err := cfg.ValidateFor(used); err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if opts.Logger != nil {
+		logger.Configure(logger.ParseLevel(cfg.Logging.Level), opts.Logger)
+	}
+
+	if used.Spool {
+		s.storage = storage.NewManager(cfg.Storage.OutputDir, cfg.Storage.MaxFiles, cfg.Storage.MinDiskSpace)
+		if err := s.storage.EnsureWritable(); err != nil {
+			s.closeResources()
+			return nil, fmt.Errorf("storage check failed: %v", err)
+		}
+		if removed, err := check.RemoveStaleFiles(cfg.Storage.OutputDir); err != nil {
+			logger.Logf(logger.LevelInfo, "Failed to clean up the spool directory: %v", err)
+		} else if removed > 0 {
+			logger.Logf(logger.LevelInfo, "Removed %d stale temporary and placeholder files from the spool directory", removed)
+		}
+		if stats, err := s.storage.GetStats(); err == nil {
+			logger.Logf(logger.LevelInfo, "Storage stats: %v", stats)
+		}
+	}
+
+	if s.db == nil {
+		dbManager, err := db.NewManager(cfg.DatabasePath)
+		if err != nil {
+			s.closeResources()
+			return nil, fmt.Errorf("failed to initialize database: %v", err)
+		}
+		s.db = dbManager
+	}
+
+	if err := s.init(used); err != nil {
+		s.closeResources()
+		return nil, err
+	}
+	return s, nil
+}
+
+// init builds the components that depend on the storage and database managers
+func (s *Server) init(used config.Components) error {
+	if used.NagiosConfig {
+		generator, err := nagios_config.NewGenerator(&s.cfg.Nagios, s.db)
+		if err != nil {
+			return fmt.Errorf("failed to create Nagios config generator: %v", err)
+		}
+		generator.SetClock(s.now)
+		s.generator = generator
+	}
+
+	s.commands = s.newCommandWriter()
+	handler, err := s.newHandler()
+	if err != nil {
+		return err
+	}
+	s.handler = handler
+
+	s.httpServer = &http.Server{Addr: s.cfg.Server.ListenAddr, Handler: s.mux}
+	if s.listen && s.cfg.Server.TLS.Enabled {
+		t := s.cfg.Server.TLS
+		tlsConfig, reloader, err := tlsutil.NewServerConfig(tlsutil.Options{
+			CertFile:     t.CertFile,
+			KeyFile:      t.KeyFile,
+			MinVersion:   t.MinVersion,
+			ClientCAFile: t.ClientCAFile,
+			ClientAuth:   t.ClientAuth,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %v", err)
+		}
+		s.httpServer.TLSConfig = tlsConfig
+		s.certReloader = reloader
+	}
+
+	s.registerRoutes()
+	return nil
+}
+
+// ServeHTTP serves the NRDP endpoint, the health endpoints and the metrics endpoint
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start starts the background components and, with Options.Listen, begins serving HTTP.
+// The listening socket is bound before Start returns, so address errors are reported
+// here; errors from the running server are delivered on Err.
+func (s *Server) Start() error {
+	if s.started {
+		return errors.New("already started")
+	}
+	if s.listen {
+		listener, err := net.Listen("tcp", s.cfg.Server.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", s.cfg.Server.ListenAddr, err)
+		}
+		s.listener = listener
+	}
+	s.started = true
+
+	s.stopMonitor = s.monitorSystem()
+	if s.generator != nil {
+		s.generator.Start()
+		go s.watchNagiosConfigReload()
+	}
+	if s.queueDrainer != nil {
+		s.queueDrainer.Start()
+	}
+
+	switch {
+	case s.listener == nil:
+		logger.Logf(logger.LevelInfo, "NRDP server started without a listener")
+	case s.certReloader != nil:
+		reloadInterval, _ := time.ParseDuration(s.cfg.Server.TLS.ReloadInterval) // Validated in config.Validate
+		s.certReloader.Watch(reloadInterval)
+		logger.Logf(logger.LevelInfo, "Starting TLS server on %s (minimum TLS %s, client certificates: %s)...", s.listener.Addr(), s.cfg.Server.TLS.MinVersion, s.clientCertMode())
+		go s.serve(func() error { return s.httpServer.ServeTLS(s.listener, "", "") })
+	default:
+		logger.Logf(logger.LevelInfo, "Starting server on %s...", s.listener.Addr())
+		go s.serve(func() error { return s.httpServer.Serve(s.listener) })
+	}
+	return nil
+}
+
+// serve runs the HTTP server and reports unexpected failures on serveErr
+func (s *Server) serve(run func() error) {
+	if err := run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.serveErr <- err
+	}
+}
+
+// Err returns a channel that receives an error if the HTTP server fails after Start
+func (s *Server) Err() <-chan error {
+	return s.serveErr
+}
+
+// Addr returns the address the server listens on, nil before Start or without Options.Listen
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop shuts everything down in order: stop accepting connections and let in-flight
+// requests finish until ctx expires, stop the background goroutines, flush the queue
+// and sinks, and finally close the database. An embedding application should stop
+// routing requests to the Server before calling Stop.
+func (s *Server) Stop(ctx context.Context) error {
+	var errs []error
+	if s.started {
+		if s.listener != nil {
+			if err := s.httpServer.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("HTTP server did not shut down cleanly: %v", err))
+			}
+		}
+		if s.certReloader != nil {
+			s.certReloader.Stop()
+		}
+		if s.generator != nil {
+			s.generator.Stop()
+		}
+		s.stopMonitor()
+		if s.queueDrainer != nil {
+			s.queueDrainer.Stop()
+		}
+		s.started = false
+	}
+	if err := s.closeResources(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// closeResources closes the queue, sinks, command writer and database, whichever are open
+func (s *Server) closeResources() error {
+	var errs []error
+	if s.ingestQueue != nil {
+		if _, _, pending, _ := s.ingestQueue.Peek(); pending {
+			logger.Logf(logger.LevelInfo, "Undelivered results remain in the ingest queue and will be delivered on the next start")
+		}
+		if err := s.ingestQueue.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close ingest queue: %v", err))
+		}
+		s.ingestQueue = nil
+	}
+	if s.handler != nil {
+		if err := s.handler.processor.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close result sinks: %v", err))
+		}
+		if s.handler.dbBatch != nil {
+			// Pending status updates must reach the database before it is closed below
+			if err := s.handler.dbBatch.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to write pending database updates: %v", err))
+			}
+		}
+		s.handler = nil
+	}
+	if s.deliveryProcessor != nil {
+		if err := s.deliveryProcessor.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close result sinks: %v", err))
+		}
+		s.deliveryProcessor = nil
+	}
+	if s.sinks != nil {
+		// Supplied sinks not yet handed to a processor
+		if err := check.MultiSink(s.sinks).Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close result sinks: %v", err))
+		}
+		s.sinks = nil
+	}
+	if s.commands != nil {
+		s.commands.Close()
+		s.commands = nil
+	}
+	if s.db != nil {
+		if err := s.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close database: %v", err))
+		}
+		s.db = nil
+	}
+	return errors.Join(errs...)
+}
+
+// registerRoutes installs the NRDP endpoint, the health endpoints and, when configured, the metrics endpoint
+func (s *Server) registerRoutes() {
+	s.mux.Handle("/", metrics.CountRequests(http.HandlerFunc(s.handler.handleRequest)))
+	s.mux.Handle("/healthz", health.LiveHandler())
+	s.mux.Handle("/readyz", s.newReadinessChecker().ReadyHandler())
+	if s.cfg.Server.MetricsPath != "" {
+		s.registry.Register(metrics.DefaultRegistry)
+		if s.storage != nil {
+			s.registry.Register(metrics.NewStorageCollector(s.storage))
+		}
+		s.registry.Register(metrics.CollectorFunc(s.handler.limits.collect))
+		if s.cfg.Server.MetricsCheckStates {
+			s.registry.Register(metrics.NewCheckStateCollector(s.db, s.cfg.Server.MetricsMaxSeries))
+		}
+		// Metrics can reveal every host and service, so they get the same source filtering as the
+		// NRDP endpoint; the health endpoints stay open for load balancers and orchestrators
+		s.mux.Handle(s.cfg.Server.MetricsPath, s.handler.restrictSource(s.registry.Handler()))
+		logger.Logf(logger.LevelInfo, "Serving Prometheus metrics on %s", s.cfg.Server.MetricsPath)
+	}
+}
+
+// newReadinessChecker builds the checks behind /readyz: the spool directory must be writable,
+// have enough free space and not be full, the database must answer and config generation
+// must have succeeded recently. Checks for components the options replaced are left out.
+func (s *Server) newReadinessChecker() *health.Checker {
+	storageManager, dbManager, generator := s.storage, s.db, s.generator
+	checker := health.NewChecker()
+	if storageManager != nil {
+		checker.Add("spool_writable", func(ctx context.Context) error {
+			return storageManager.EnsureWritable()
+		})
+		checker.Add("spool_space", func(ctx context.Context) error {
+			return storageManager.CheckSpace()
+		})
+		checker.Add("spool_files", func(ctx context.Context) error {
+			tooMany, err := storageManager.CheckFiles()
+			if err != nil {
+				return err
+			}
+			if tooMany {
+				return check.ErrSpoolFull
+			}
+			return nil
+		})
+	}
+	checker.Add("database", dbManager.Ping)
+	if generator != nil {
+		checker.Add("config_generator", func(ctx context.Context) error {
+			return generator.CheckHealth()
+		})
+	}
+	return checker
+}
+
+// clientCertMode describes the client certificate policy for the startup log
+func (s *Server) clientCertMode() string {
+	if s.cfg.Server.TLS.ClientCAFile == "" {
+		return "not requested"
+	}
+	return s.cfg.Server.TLS.ClientAuth
+}
+
+// logAllRequests reports whether the DEBUG environment variable asks for every request to be logged
+func logAllRequests() bool {
+	debugEnv := strings.ToLower(os.Getenv("DEBUG"))
+	return debugEnv == "1" || debugEnv == "true"
+}
+
+// watchNagiosConfigReload listens on the generator's reload channel and executes the reload command.
+func (s *Server) watchNagiosConfigReload() {
+	reloadChan, reloadCmd := s.generator.ReloadChan, s.cfg.Nagios.ReloadCommand
+	if reloadCmd == "" {
+		logger.Logf(logger.LevelInfo, "Nagios reload command is empty, watcher will not execute commands.")
+		// Keep listening to drain the channel if necessary, but do nothing.
+		for range reloadChan {
+			logger.Logf(logger.LevelDebug, "Received Nagios config update signal, but no reload command configured.")
+		}
+		return
+	}
+
+	logger.Logf(logger.LevelInfo, "Starting Nagios reload watcher (command: '%s')", reloadCmd)
+	for range reloadChan {
+		logger.Logf(logger.LevelInfo, "Received Nagios config update signal. Attempting to execute reload command...")
+		executeReloadCommand(reloadCmd)
+	}
+	logger.Logf(logger.LevelInfo, "Nagios reload watcher stopped.") // ReloadChan is closed when the generator stops
+}
+
+// executeReloadCommand runs the configured command to reload Nagios.
+func executeReloadCommand(command string) {
+	logger.Logf(logger.LevelDebug, "Executing reload command: %s", command)
+
+	// Use sh -c to handle potential pipelines or complex commands in the string
+	cmd := exec.Command("sh", "-c", command)
+
+	// Capture combined output (stdout and stderr)
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		logger.Logf(logger.LevelInfo, "Warning: Failed to execute Nagios reload command '%s': %v. Output: %s", command, err, string(output))
+		metrics.ReloadsTotal.Inc("failure")
+		return
+	}
+
+	logger.Logf(logger.LevelInfo, "Successfully executed Nagios reload command '%s'. Output: %s", command, string(output))
+	metrics.ReloadsTotal.Inc("success")
+}
+
+// monitorSystem logs system metrics every second until the returned stop function is
+// called; stop returns once the monitor has exited
+func (s *Server) monitorSystem() (stop func()) {
+	verbose := s.cfg.Logging.Verbose
+	ticker := time.NewTicker(time.Second)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		// Log initial metrics
+		currentMetrics := metrics.GetMetrics()
+		if verbose {
+			logger.Logf(logger.LevelDebug, "%s", currentMetrics.DetailString())
+		} else {
+			logger.Logf(logger.LevelDebug, "%s", currentMetrics.String())
+		}
+
+		lastMetrics := currentMetrics
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			currentMetrics = metrics.GetMetrics()
+
+			// Log metrics based on verbosity and changes
+			if verbose || currentMetrics.HasSignificantChanges(lastMetrics) {
+				logger.Logf(logger.LevelDebug, "%s", currentMetrics.DetailString())
+			} else {
+				logger.Logf(logger.LevelDebug, "%s", currentMetrics.String())
+			}
+
+			lastMetrics = currentMetrics
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,446 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/config"
+	"nrdp_micro/db"
+	"nrdp_micro/nrdp"
+)
+
+// recordingSink collects the results delivered to it, or fails with err when set
+type recordingSink struct {
+	mu      sync.Mutex
+	results []check.Result
+	err     error
+}
+
+func (s *recordingSink) Write(ctx context.Context, results []check.Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.results = append(s.results, results...)
+	return nil
+}
+
+func (s *recordingSink) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// failingSink refuses every write
+type failingSink struct{}
+
+func (failingSink) Write(ctx context.Context, results []check.Result) error {
+	return errors.New("destination unavailable")
+}
+
+func (failingSink) Close() error { return nil }
+
+func (s *recordingSink) Results() []check.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]check.Result(nil), s.results...)
+}
+
+// testOptions returns the options for a server with token "secret" that delivers to the
+// returned sink, keeps its database in a temporary directory and does not touch Nagios
+func testOptions(t *testing.T) (Options, *recordingSink) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Server.ListenAddr = "127.0.0.1:0"
+	cfg.Server.Tokens = []config.Token{{Token: "secret"}}
+	cfg.DatabasePath = filepath.Join(t.TempDir(), "status.db")
+
+	sink := &recordingSink{}
+	return Options{
+		Config:              *cfg,
+		Logger:              log.New(io.Discard, "", 0),
+		Sinks:               []check.Sink{sink},
+		DisableNagiosConfig: true,
+	}, sink
+}
+
+// newTestServer builds a server from testOptions, delivering to any further sinks given too
+func newTestServer(t *testing.T, listen bool, more ...check.Sink) (*Server, *recordingSink) {
+	t.Helper()
+	opts, sink := testOptions(t)
+	opts.Listen = listen
+	opts.Sinks = append(opts.Sinks, more...)
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv, sink
+}
+
+// post sends the form to the server's NRDP endpoint and decodes the response
+func post(t *testing.T, h http.Handler, form url.Values) (int, nrdp.Response) {
+	t.Helper()
+	return postFrom(t, h, "192.0.2.1:1234", form)
+}
+
+// postFrom is post with the given client address
+func postFrom(t *testing.T, h http.Handler, remoteAddr string, form url.Values) (int, nrdp.Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp, err := nrdp.Decode(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestHello(t *testing.T) {
+	srv, _ := newTestServer(t, false)
+	defer srv.Stop(context.Background())
+
+	code, resp := post(t, srv, url.Values{"cmd": {"hello"}})
+	if code != http.StatusOK || resp.Status != nrdp.StatusOK {
+		t.Fatalf("hello = %d status %d, want 200 status %d", code, resp.Status, nrdp.StatusOK)
+	}
+	if resp.Product != "nrdp_micro" || resp.Version != Version {
+		t.Errorf("hello product %q version %q, want nrdp_micro %s", resp.Product, resp.Version, Version)
+	}
+}
+
+func TestSubmitCheck(t *testing.T) {
+	srv, sink := newTestServer(t, false)
+	defer srv.Stop(context.Background())
+
+	jsonData := `{"checkresults": [
+		{"checkresult": {"type": "host"}, "hostname": "web01", "state": 0, "output": "UP"},
+		{"checkresult": {"type": "service"}, "hostname": "web01", "servicename": "HTTP", "state": 2, "output": "down | time=5s"},
+		{"checkresult": {"type": "service"}, "hostname": "web01\nhost_name=db01", "servicename": "HTTP", "state": 0, "output": "OK"}
+	]}`
+	code, resp := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}})
+	if code != http.StatusOK {
+		t.Fatalf("submitcheck = %d %+v, want 200", code, resp)
+	}
+	if resp.Meta == nil || resp.Meta.Accepted != 2 || len(resp.Meta.Rejected) != 1 || resp.Meta.Rejected[0].Index != 2 {
+		t.Fatalf("submitcheck meta = %+v, want 2 accepted and result 2 rejected", resp.Meta)
+	}
+
+	results := sink.Results()
+	if len(results) != 2 {
+		t.Fatalf("sink received %d results, want 2", len(results))
+	}
+	if r := results[1]; r.HostName != "web01" || r.ServiceName != "HTTP" || r.State != 2 || r.Output != "down | time=5s" {
+		t.Errorf("sink received %+v", r)
+	}
+}
+
+func TestSubmitCheckPartialDelivery(t *testing.T) {
+	srv, sink := newTestServer(t, false, failingSink{})
+	defer srv.Stop(context.Background())
+
+	jsonData := `{"checkresults": [{"checkresult": {"type": "host"}, "hostname": "web01", "state": 0, "output": "UP"}]}`
+	code, resp := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}})
+	if code != http.StatusOK || resp.Status != nrdp.StatusOK {
+		t.Fatalf("submitcheck = %d %+v, want 200 so the client does not resend", code, resp)
+	}
+	if resp.Meta == nil || resp.Meta.Accepted != 1 || len(resp.Meta.Rejected) != 0 {
+		t.Errorf("submitcheck meta = %+v, want the result accepted", resp.Meta)
+	}
+	if results := sink.Results(); len(results) != 1 {
+		t.Errorf("working sink received %d results, want 1", len(results))
+	}
+}
+
+func TestSubmitCheckRecordsStatusOnlyWhenDelivered(t *testing.T) {
+	srv, sink := newTestServer(t, false)
+	defer srv.Stop(context.Background())
+	submit := func(host string) int {
+		jsonData := `{"checkresults": [{"checkresult": {"type": "host"}, "hostname": "` + host + `", "state": 0, "output": "UP"}]}`
+		code, _ := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}})
+		return code
+	}
+
+	sink.Fail(errors.New("destination unavailable"))
+	if code := submit("web01"); code != http.StatusInternalServerError {
+		t.Fatalf("submitcheck with a failing sink = %d, want 500", code)
+	}
+	sink.Fail(nil)
+	if code := submit("web02"); code != http.StatusOK {
+		t.Fatalf("submitcheck = %d, want 200", code)
+	}
+
+	hosts, err := srv.db.GetAllHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "web02" {
+		t.Errorf("hosts in the database = %+v, want only web02", hosts)
+	}
+}
+
+func TestSubmitCheckAuthFailure(t *testing.T) {
+	srv, sink := newTestServer(t, false)
+	defer srv.Stop(context.Background())
+
+	xmlData := `<?xml version="1.0"?><checkresults><checkresult type="host"><hostname>web01</hostname><state>0</state><output>UP</output></checkresult></checkresults>`
+	tests := []struct {
+		name  string
+		token []string
+		want  int
+	}{
+		{"missing token", nil, http.StatusUnauthorized},
+		{"bad token", []string{"wrong"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": tt.token, "XMLDATA": {xmlData}})
+			if code != tt.want || resp.Status != nrdp.StatusError {
+				t.Errorf("submitcheck = %d status %d, want %d status %d", code, resp.Status, tt.want, nrdp.StatusError)
+			}
+		})
+	}
+	if results := sink.Results(); len(results) != 0 {
+		t.Errorf("sink received %d results from unauthenticated requests", len(results))
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	srv, _ := newTestServer(t, true)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Error("second Start succeeded")
+	}
+	addr := srv.Addr()
+	if addr == nil {
+		t.Fatal("Addr is nil after Start")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.PostForm("http://"+addr.String()+"/", url.Values{"cmd": {"hello"}})
+	if err != nil {
+		t.Fatalf("hello over the listener: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("hello over the listener = %d, want 200", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if _, err := client.PostForm("http://"+addr.String()+"/", url.Values{"cmd": {"hello"}}); err == nil {
+		t.Error("server still answers after Stop")
+	}
+	select {
+	case err := <-srv.Err():
+		t.Errorf("server reported %v", err)
+	default:
+	}
+}
+
+// unreachableStore is a status database whose connection is gone
+type unreachableStore struct {
+	db.Store
+}
+
+func (unreachableStore) Ping(ctx context.Context) error { return errors.New("database is locked") }
+func (unreachableStore) Close() error                   { return nil }
+
+func TestHealthEndpoints(t *testing.T) {
+	opts, _ := testOptions(t)
+	opts.Store = unreachableStore{}
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Stop(context.Background())
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+		if tt.path == "/readyz" && !strings.Contains(rec.Body.String(), "database is locked") {
+			t.Errorf("%s body %q does not name the failing check", tt.path, rec.Body.String())
+		}
+	}
+}
+
+func TestConfiguredSinks(t *testing.T) {
+	opts, _ := testOptions(t)
+	opts.Sinks = nil
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skipf("looking up the current group: %v", err)
+	}
+	spoolDir := t.TempDir()
+	opts.Config.Storage.OutputDir = spoolDir
+	opts.Config.Storage.GroupName = group.Name
+	opts.Config.Storage.Sinks = []string{"spool", "command_file"}
+
+	commandFile := filepath.Join(t.TempDir(), "nagios.cmd")
+	if err := syscall.Mkfifo(commandFile, 0600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	// Read the command file the way Nagios does, without waiting for a writer
+	fifo, err := os.OpenFile(commandFile, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fifo.Close()
+	opts.Config.Nagios.CommandFile = commandFile
+
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Stop(context.Background())
+
+	jsonData := `{"checkresults": [{"checkresult": {"type": "service"}, "hostname": "web01", "servicename": "HTTP", "state": 1, "output": "slow", "time": 1700000000}]}`
+	code, resp := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}})
+	if code != http.StatusOK || resp.Meta == nil || resp.Meta.Accepted != 1 {
+		t.Fatalf("submitcheck = %d %+v, want 200 with the result accepted", code, resp)
+	}
+
+	// Every configured sink receives the result, in the configured order
+	files, err := filepath.Glob(filepath.Join(spoolDir, "c??????"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("spool files = %v, %v, want one", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "host_name=web01\n") || !strings.Contains(string(data), "service_description=HTTP\n") {
+		t.Errorf("spool file:\n%s", data)
+	}
+	if _, err := os.Stat(files[0] + ".ok"); err != nil {
+		t.Errorf("spool file not marked ready: %v", err)
+	}
+
+	line, err := bufio.NewReader(fifo).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the command file: %v", err)
+	}
+	if want := "[1700000000] PROCESS_SERVICE_CHECK_RESULT;web01;HTTP;1;slow\n"; line != want {
+		t.Errorf("command file received %q, want %q", line, want)
+	}
+}
+
+// recordingStore keeps the status updates written to it in memory
+type recordingStore struct {
+	db.Store
+	mu      sync.Mutex
+	updates []db.Update
+	closed  bool
+}
+
+func (s *recordingStore) ApplyUpdates(updates []db.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, updates...)
+	return nil
+}
+
+func (s *recordingStore) Ping(ctx context.Context) error { return nil }
+
+func (s *recordingStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// closeRecordingSink is a recordingSink that notes when it is closed
+type closeRecordingSink struct {
+	recordingSink
+	closed bool
+}
+
+func (s *closeRecordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestNewServerWithInjectedDependencies(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	cfg := config.DefaultConfig()
+	cfg.Server.Tokens = []config.Token{{Token: "secret"}}
+	// None of these exist, and none are needed with the components replaced
+	cfg.Storage.OutputDir = filepath.Join(missing, "spool")
+	cfg.DatabasePath = filepath.Join(missing, "db", "status.db")
+	cfg.Nagios.OutputDir = filepath.Join(missing, "nagios")
+
+	store := &recordingStore{}
+	sink := &closeRecordingSink{}
+	now := time.Unix(1700000000, 0)
+	srv, err := NewServer(Options{
+		Config:              *cfg,
+		Logger:              log.New(io.Discard, "", 0),
+		Sinks:               []check.Sink{sink},
+		Store:               store,
+		Clock:               func() time.Time { return now },
+		DisableNagiosConfig: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	jsonData := `{"checkresults": [{"checkresult": {"type": "service"}, "hostname": "web01", "servicename": "HTTP", "state": 0, "output": "OK | time=0.1s"}]}`
+	if code, resp := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}}); code != http.StatusOK {
+		t.Fatalf("submitcheck = %d %+v, want 200", code, resp)
+	}
+	if results := sink.Results(); len(results) != 1 || results[0].HostName != "web01" {
+		t.Errorf("sink received %+v", results)
+	}
+	store.mu.Lock()
+	updates := store.updates
+	store.mu.Unlock()
+	if len(updates) != 1 || updates[0].ServiceDescription != "HTTP" || !updates[0].Time.Equal(now) || len(updates[0].PerfData) != 1 {
+		t.Errorf("store received %+v, want the HTTP status at the injected time", updates)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("server created %s: %v", missing, err)
+	}
+
+	if err := srv.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if !store.closed || !sink.closed {
+		t.Errorf("after Stop store closed %v, sink closed %v, want both closed", store.closed, sink.closed)
+	}
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"nrdp_micro/auth"
+	"nrdp_micro/batcher"
+	"nrdp_micro/check"
+	"nrdp_micro/db"
+	"nrdp_micro/extcmd"
+	"nrdp_micro/logger"
+	"nrdp_micro/perfexport"
+	"nrdp_micro/queue"
+)
+
+// newHandler builds the NRDP request handler with its authentication, access control,
+// rate limiting and result processing settings
+func (s *Server) newHandler() (*Handler, error) {
+	tokens, err := s.newTokens()
+	if err != nil {
+		return nil, err
+	}
+	clientHosts, err := auth.NewClientHosts(s.cfg.Server.TLS.ClientHosts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server tls client_hosts: %v", err)
+	}
+	network, err := s.newNetworkPolicy()
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := auth.ParseNetworks(s.cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server trusted_proxies: %v", err)
+	}
+	processor, err := s.newIngestProcessor()
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		db:             s.db,
+		dbBatch:        s.newStatusBatcher(),
+		tokens:         tokens,
+		clientHosts:    clientHosts,
+		network:        network,
+		trustedProxies: trustedProxies,
+		limits:         s.newRateLimits(),
+		commands:       s.commands,
+		processor:      processor,
+		showRaw:        s.cfg.Logging.ShowRaw,
+		logAllRequests: logAllRequests(),
+		retryAfter:     s.retryAfterSeconds(),
+		now:            s.now,
+	}, nil
+}
+
+// newStatusBatcher builds the batcher that coalesces status updates across submissions
+// in database_batch window mode, nil in request mode
+func (s *Server) newStatusBatcher() *batcher.Batcher[db.Update] {
+	if s.cfg.DatabaseBatch.Mode != "window" {
+		return nil
+	}
+	maxDelay, _ := time.ParseDuration(s.cfg.DatabaseBatch.MaxDelay) // Validated in config.Validate
+	logger.Logf(logger.LevelInfo, "Coalescing database writes: up to %d updates or %s per transaction", s.cfg.DatabaseBatch.MaxUpdates, maxDelay)
+	return batcher.New("status updates", s.db.ApplyUpdates, s.cfg.DatabaseBatch.MaxUpdates, maxDelay)
+}
+
+// newNetworkPolicy builds the source address allow/deny lists
+func (s *Server) newNetworkPolicy() (auth.NetworkPolicy, error) {
+	allow, err := auth.ParseNetworks(s.cfg.Server.Access.Allow)
+	if err != nil {
+		return auth.NetworkPolicy{}, fmt.Errorf("invalid server access allow list: %v", err)
+	}
+	deny, err := auth.ParseNetworks(s.cfg.Server.Access.Deny)
+	if err != nil {
+		return auth.NetworkPolicy{}, fmt.Errorf("invalid server access deny list: %v", err)
+	}
+	return auth.NetworkPolicy{Allow: allow, Deny: deny}, nil
+}
+
+// newTokens builds the token set from the configuration and warns when authentication is disabled.
+func (s *Server) newTokens() (*auth.Tokens, error) {
+	configured := make([]auth.Token, 0, len(s.cfg.Server.Tokens))
+	for _, token := range s.cfg.Server.Tokens {
+		configured = append(configured, auth.Token{Value: token.Token, Hosts: token.Hosts, HostPrefix: token.HostPrefix})
+	}
+	tokens, err := auth.NewTokens(configured)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server tokens: %v", err)
+	}
+	if !tokens.Enabled() {
+		logger.Logf(logger.LevelInfo, "Warning: no server tokens configured, NRDP token authentication is disabled")
+	}
+	return tokens, nil
+}
+
+// newIngestProcessor returns the processor used by the HTTP handler. With the queue enabled,
+// results are appended to the durable queue and a drainer, started by Start, delivers them
+// to the sinks.
+func (s *Server) newIngestProcessor() (*check.Processor, error) {
+	processor, err := s.newProcessor()
+	if err != nil {
+		return nil, err
+	}
+	if !s.cfg.Queue.Enabled {
+		return processor, nil
+	}
+
+	q, err := queue.Open(s.cfg.Queue.Dir, s.cfg.Queue.SegmentSize, s.cfg.Queue.MaxSize)
+	if err != nil {
+		processor.Close()
+		return nil, fmt.Errorf("failed to open ingest queue: %v", err)
+	}
+	s.ingestQueue = q
+	s.deliveryProcessor = processor
+
+	s.queueDrainer = queue.NewDrainer(q, check.QueueHandler(processor))
+
+	return check.NewProcessor(check.NewQueueSink(q)), nil
+}
+
+// newProcessor builds the result processor with the sinks listed in storage.sinks, or
+// the sinks given in Options
+func (s *Server) newProcessor() (*check.Processor, error) {
+	if s.sinks != nil {
+		sinks := s.sinks
+		s.sinks = nil // Owned by the processor from here on
+		logger.Logf(logger.LevelInfo, "Check results are delivered to %d sinks supplied by the embedding application", len(sinks))
+		return check.NewProcessor(sinks...), nil
+	}
+	var sinks []check.Sink
+	for _, name := range s.cfg.Storage.Sinks {
+		switch name {
+		case "spool":
+			sinks = append(sinks, s.newSpoolSink())
+		case "command_file":
+			sinks = append(sinks, check.NewCommandFileSink(s.commands))
+		case "perfdata_export":
+			exporter, err := s.newPerfDataExporter()
+			if err != nil {
+				check.MultiSink(sinks).Close()
+				return nil, err
+			}
+			sinks = append(sinks, exporter)
+		}
+	}
+	logger.Logf(logger.LevelInfo, "Check results are delivered to sinks: %s", strings.Join(s.cfg.Storage.Sinks, ", "))
+	return check.NewProcessor(sinks...), nil
+}
+
+// retryAfterSeconds returns the Retry-After value sent when the spool is saturated
+func (s *Server) retryAfterSeconds() int {
+	pause, _ := time.ParseDuration(s.cfg.Storage.PauseDuration) // Validated in config.Validate
+	if seconds := int(pause.Round(time.Second) / time.Second); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+// newSpoolSink builds the spool sink according to the storage.batch settings
+func (s *Server) newSpoolSink() check.Sink {
+	batch := s.cfg.Storage.Batch
+	if batch.Mode == "none" {
+		return check.NewSpoolSink(s.cfg.Storage.OutputDir, s.cfg.Storage.GroupName, s.storage, 1)
+	}
+
+	spool := check.NewSpoolSink(s.cfg.Storage.OutputDir, s.cfg.Storage.GroupName, s.storage, batch.MaxResults)
+	if batch.Mode == "request" {
+		return spool
+	}
+	maxDelay, _ := time.ParseDuration(batch.MaxDelay) // Validated in config.Validate
+	return check.NewBatchingSink(spool, batch.MaxResults, maxDelay)
+}
+
+// newPerfDataExporter builds the Graphite/InfluxDB exporter from the perfdata_export settings
+func (s *Server) newPerfDataExporter() (check.Sink, error) {
+	export := s.cfg.PerfDataExport
+	flushInterval, _ := time.ParseDuration(export.FlushInterval) // Validated in config.Validate
+	timeout, _ := time.ParseDuration(export.Timeout)
+	exporter, err := perfexport.New(perfexport.Options{
+		Format:        export.Format,
+		Protocol:      export.Protocol,
+		Address:       export.Address,
+		Prefix:        export.Prefix,
+		BatchSize:     export.BatchSize,
+		FlushInterval: flushInterval,
+		BufferSize:    export.BufferSize,
+		Timeout:       timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create perfdata exporter: %v", err)
+	}
+	return exporter, nil
+}
+
+// newCommandWriter returns the external command writer, or nil when no command file is configured
+func (s *Server) newCommandWriter() *extcmd.Writer {
+	if s.cfg.Nagios.CommandFile == "" {
+		logger.Logf(logger.LevelInfo, "Nagios command file not configured, submitcmd is disabled")
+		return nil
+	}
+	if len(s.cfg.Server.Tokens) == 0 {
+		logger.Logf(logger.LevelInfo, "No server tokens configured, submitcmd is disabled")
+	}
+	timeout, _ := time.ParseDuration(s.cfg.Nagios.CommandTimeout) // Validated in config.Validate
+	return extcmd.NewWriter(s.cfg.Nagios.CommandFile, timeout)
+}
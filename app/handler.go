@@ -0,0 +1,455 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/auth"
+	"nrdp_micro/batcher"
+	"nrdp_micro/check"
+	"nrdp_micro/db"
+	"nrdp_micro/extcmd"
+	"nrdp_micro/logger"
+	"nrdp_micro/metrics"
+	"nrdp_micro/nrdp"
+	"nrdp_micro/queue"
+)
+
+// Handler serves the NRDP endpoint
+type Handler struct {
+	db             db.Store
+	dbBatch        *batcher.Batcher[db.Update] // Coalesces status writes across submissions, nil in request mode
+	tokens         *auth.Tokens
+	clientHosts    *auth.ClientHosts
+	network        auth.NetworkPolicy
+	trustedProxies auth.Networks
+	limits         *rateLimits
+	commands       *extcmd.Writer
+	processor      *check.Processor
+
+	showRaw        bool             // Log the raw XMLDATA/JSONDATA of submissions
+	logAllRequests bool             // Log every incoming request, set by the DEBUG environment variable
+	retryAfter     int              // Retry-After seconds sent when the spool or queue is full
+	now            func() time.Time // Time source for last-seen timestamps
+}
+
+// client identifies the sender of a request for authorization and rate limiting
+type client struct {
+	ip    string      // Empty when the address could not be determined
+	token string      // Empty when token authentication is disabled
+	scope *auth.Scope // Hosts the client may submit for, nil when unrestricted
+}
+
+// certificateHosts returns the hosts the request's client certificate may submit results for.
+// It returns nil when the client is not restricted: no mappings are configured or no
+// certificate was presented (client_auth: optional). A certificate without a mapping is refused.
+func (h *Handler) certificateHosts(r *http.Request) (*auth.HostPatterns, error) {
+	if !h.clientHosts.Enabled() || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	hosts, ok := h.clientHosts.ForCertificate(cert)
+	if !ok {
+		return nil, fmt.Errorf("client certificate %q is not mapped to any hosts", cert.Subject.CommonName)
+	}
+	return hosts, nil
+}
+
+// allowSource applies the access allow/deny lists to the client address, answering 403
+// when it is refused
+func (h *Handler) allowSource(w http.ResponseWriter, r *http.Request) (net.IP, bool) {
+	ip := auth.ClientIP(r, h.trustedProxies)
+	if !h.network.Allowed(ip) {
+		logger.Logf(logger.LevelInfo, "Rejected request from %s (client %s): address not allowed", r.RemoteAddr, ip)
+		metrics.DeniedTotal.Inc()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return ip, true
+}
+
+// restrictSource wraps next so it is only served to addresses the access lists allow
+func (h *Handler) restrictSource(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.allowSource(w, r); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (h *Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	defer logger.Logf(logger.LevelDebug, "Handler finished for %s", r.RemoteAddr)
+
+	// Log request details if debug flag is set
+	if h.logAllRequests {
+		logger.Logf(logger.LevelInfo, "Received request: Method=%s, URL=%s, RemoteAddr=%s, UserAgent=%s",
+			r.Method, r.URL.String(), r.RemoteAddr, r.UserAgent())
+	}
+
+	// Refuse sources outside the allow list or inside the deny list before doing any work
+	ip, ok := h.allowSource(w, r)
+	if !ok {
+		return
+	}
+	// Clients without a parseable address are not limited per IP rather than sharing one bucket
+	var c client
+	if ip != nil {
+		c.ip = ip.String()
+	}
+
+	if r.Method != http.MethodPost {
+		logger.Logf(logger.LevelDebug, "Invalid request method: %s", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the form data
+	err := r.ParseForm()
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "Failed to parse form data: %v", err)
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	format := nrdp.RequestFormat(r)
+
+	// Older clients of this service post results without a cmd, so default to submitcheck
+	cmd := strings.ToLower(r.FormValue("cmd"))
+	if cmd == "" {
+		cmd = "submitcheck"
+	}
+
+	if !h.limits.allow(w, format, "requests", c, 1) {
+		return
+	}
+
+	// hello is a connectivity test and does not require a token, as in upstream NRDP
+	if cmd == "hello" {
+		h.handleHello(w, r, format)
+		return
+	}
+
+	// Authenticate the client using the NRDP token; its scope limits the hosts it may submit for
+	if h.tokens.Enabled() {
+		token := r.FormValue("token")
+		if token == "" {
+			logger.Logf(logger.LevelDebug, "Missing token in request from %s", r.RemoteAddr)
+			nrdp.Write(w, http.StatusUnauthorized, format, nrdp.Error("NO TOKEN SUPPLIED"))
+			return
+		}
+		tokenScope, ok := h.tokens.Lookup(token)
+		if !ok {
+			logger.Logf(logger.LevelInfo, "Rejected request from %s: bad token", r.RemoteAddr)
+			nrdp.Write(w, http.StatusForbidden, format, nrdp.Error("BAD TOKEN SUPPLIED"))
+			return
+		}
+		c.token, c.scope = token, tokenScope
+
+		// Requests per token are counted once the token is known to be valid
+		if !h.limits.allow(w, format, "requests", client{token: token}, 1) {
+			// The request does not count against the address either
+			h.limits.refund("requests", client{ip: c.ip}, 1)
+			return
+		}
+	}
+
+	// Further restrict the hosts by the client certificate
+	certHosts, err := h.certificateHosts(r)
+	if err != nil {
+		logger.Logf(logger.LevelInfo, "Rejected request from %s: %v", r.RemoteAddr, err)
+		nrdp.Write(w, http.StatusForbidden, format, nrdp.Error("CLIENT CERTIFICATE NOT AUTHORIZED"))
+		return
+	}
+	if certHosts != nil {
+		c.scope = c.scope.Restrict(certHosts)
+	}
+
+	switch cmd {
+	case "submitcheck":
+		h.handleSubmitCheck(w, r, format, c)
+	case "submitcmd":
+		// External commands can disable checks or notifications anywhere, so they are never
+		// accepted from unauthenticated clients
+		if !h.tokens.Enabled() {
+			logger.Logf(logger.LevelInfo, "Rejected submitcmd from %s: no tokens configured", r.RemoteAddr)
+			nrdp.Write(w, http.StatusForbidden, format, nrdp.Error("COMMANDS REQUIRE TOKEN AUTHENTICATION"))
+			return
+		}
+		// External commands can affect any host, so host-restricted clients may not send them
+		if c.scope.Restricted() {
+			logger.Logf(logger.LevelInfo, "Rejected submitcmd from host-restricted client %s", r.RemoteAddr)
+			nrdp.Write(w, http.StatusForbidden, format, nrdp.Error("COMMANDS NOT ALLOWED FOR THIS CLIENT"))
+			return
+		}
+		h.handleSubmitCmd(w, r, format)
+	default:
+		logger.Logf(logger.LevelDebug, "Invalid command '%s' from %s", cmd, r.RemoteAddr)
+		nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("INVALID COMMAND"))
+	}
+}
+
+// handleHello answers the NRDP connectivity test
+func (h *Handler) handleHello(w http.ResponseWriter, r *http.Request, format nrdp.Format) {
+	resp := nrdp.OK("OK")
+	resp.Product = "nrdp_micro"
+	resp.Version = Version
+	nrdp.Write(w, http.StatusOK, format, resp)
+}
+
+// handleSubmitCheck processes the check results posted in XMLDATA and/or JSONDATA. The client's scope, when not nil, rewrites
+// hostnames with its forced prefix and rejects results for hosts it may not submit for.
+func (h *Handler) handleSubmitCheck(w http.ResponseWriter, r *http.Request, format nrdp.Format, c client) {
+	// Extract the XML and JSON data from the form
+	xmlData := r.FormValue("XMLDATA")
+	jsonData := r.FormValue("JSONDATA")
+	if xmlData == "" && jsonData == "" {
+		logger.Logf(logger.LevelDebug, "Missing XMLDATA/JSONDATA in request")
+		nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("NO DATA"))
+		return
+	}
+
+	var results check.Results
+
+	if xmlData != "" {
+		// Log the raw XML data if requested
+		if h.showRaw {
+			logger.Logf(logger.LevelDebug, "Raw XMLDATA: %s", xmlData)
+		}
+
+		// Parse the XML data
+		parsed, err := check.ParseXML([]byte(xmlData))
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "Failed to parse XML data: %v", err)
+			metrics.ParseFailuresTotal.Inc("xml")
+			nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("BAD XML"))
+			return
+		}
+		results.CheckResult = append(results.CheckResult, parsed.CheckResult...)
+	}
+
+	if jsonData != "" {
+		// Log the raw JSON data if requested
+		if h.showRaw {
+			logger.Logf(logger.LevelDebug, "Raw JSONDATA: %s", jsonData)
+		}
+
+		// Parse the JSON data
+		parsed, err := check.ParseJSON([]byte(jsonData))
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "Failed to parse JSON data: %v", err)
+			metrics.ParseFailuresTotal.Inc("json")
+			nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("BAD JSON"))
+			return
+		}
+		results.CheckResult = append(results.CheckResult, parsed.CheckResult...)
+	}
+
+	if !h.limits.allow(w, format, "results", c, len(results.CheckResult)) {
+		return
+	}
+
+	// Log check results summary
+	results.LogSummary()
+
+	// Get current time for last_seen updates
+	now := h.now()
+
+	var updates []db.Update
+	meta := &nrdp.Meta{}
+	var processErr error
+
+	// Valid results and their positions in the submission
+	var valid []check.Result
+	var validIndex []int
+
+	for i := range results.CheckResult {
+		result := &results.CheckResult[i]
+
+		// Reject invalid results individually instead of failing the whole submission
+		if err := result.Validate(); err != nil {
+			logger.Logf(logger.LevelDebug, "Rejected check result %d for %s - %s: %v", i, result.HostName, result.ServiceName, err)
+			meta.Rejected = append(meta.Rejected, rejection(i, *result, err))
+			continue
+		}
+		// Enforce the client's host scope before anything is recorded or delivered
+		hostname, authErr := c.scope.Hostname(result.HostName)
+		if authErr != nil {
+			logger.Logf(logger.LevelInfo, "Rejected check result %d from %s: %v", i, r.RemoteAddr, authErr)
+			meta.Rejected = append(meta.Rejected, rejection(i, *result, authErr))
+			continue
+		}
+		result.HostName = hostname
+
+		// Collect the last_seen, state and perfdata updates, written together once delivered
+		serviceName := result.ServiceName
+		if result.IsHost() { // Host check results have no service entry
+			serviceName = ""
+		}
+		updates = append(updates, db.Update{
+			Hostname:           result.HostName,
+			ServiceDescription: serviceName,
+			State:              result.State,
+			PerfData:           perfDataRows(result.PluginOutput()),
+			Time:               now,
+		})
+
+		valid = append(valid, *result)
+		validIndex = append(validIndex, i)
+	}
+
+	// Hand the valid results to the sinks. Results that reached some of them count as
+	// accepted, since a resubmission would duplicate them in the others.
+	err := h.processor.Process(r.Context(), valid)
+	if errors.Is(err, check.ErrPartialDelivery) {
+		logger.Logf(logger.LevelInfo, "Accepted %d check results from %s, but %v", len(valid), r.RemoteAddr, err)
+		err = nil
+	}
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "Failed to process %d check results: %v", len(valid), err)
+		for j, result := range valid {
+			meta.Rejected = append(meta.Rejected, rejection(validIndex[j], result, err))
+		}
+		processErr = err
+	} else {
+		meta.Accepted = len(valid)
+		for _, result := range valid {
+			metrics.ResultsAcceptedTotal.Inc(resultType(result), result.Label())
+		}
+		// Status is only recorded for accepted results, so a resubmission of rejected ones
+		// is the first to be recorded. Once accepted it is recorded even if the client has gone.
+		h.writeUpdates(context.WithoutCancel(r.Context()), updates)
+	}
+	metrics.ResultsRejectedTotal.Add(float64(len(meta.Rejected)))
+
+	h.writeSubmitResponse(w, format, len(results.CheckResult), meta, processErr)
+}
+
+// writeUpdates stores the status updates of a submission in one transaction, or hands
+// them to the batch writer to share a transaction with concurrent submissions. Failures
+// are logged but do not reject the results, which are still delivered to the sinks.
+func (h *Handler) writeUpdates(ctx context.Context, updates []db.Update) {
+	if len(updates) == 0 {
+		return
+	}
+	start := time.Now()
+	var err error
+	if h.dbBatch != nil {
+		err = h.dbBatch.Add(ctx, updates)
+	} else {
+		err = h.db.ApplyUpdates(updates)
+	}
+	metrics.DBWriteSeconds.Observe(time.Since(start).Seconds(), "updates")
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "Failed to store %d check result updates in DB: %v", len(updates), err)
+	}
+}
+
+// resultType returns the type label used in metrics for a check result
+func resultType(result check.Result) string {
+	if result.IsHost() {
+		return check.TypeHost
+	}
+	return check.TypeService
+}
+
+// perfDataRows converts parsed performance data into database rows
+func perfDataRows(output *check.Output) []db.PerfData {
+	rows := make([]db.PerfData, 0, len(output.PerfData))
+	for _, p := range output.PerfData {
+		rows = append(rows, db.PerfData{
+			Label: p.Label,
+			Value: p.Value,
+			UOM:   p.UOM,
+			Warn:  p.Warn,
+			Crit:  p.Crit,
+			Min:   p.Min,
+			Max:   p.Max,
+		})
+	}
+	return rows
+}
+
+// rejection builds the response entry for a check result that was not accepted
+func rejection(index int, result check.Result, err error) nrdp.Rejection {
+	return nrdp.Rejection{
+		Index:       index,
+		HostName:    result.HostName,
+		ServiceName: result.ServiceName,
+		Reason:      err.Error(),
+	}
+}
+
+// writeSubmitResponse reports the outcome of a check submission.
+// Partially accepted submissions still return status 0 so clients do not resend
+// the results that were processed, with the rejected entries listed in the meta section.
+// When the spool is saturated the client is told to retry later with 503 and Retry-After
+// instead of the request being held open until Nagios catches up.
+func (h *Handler) writeSubmitResponse(w http.ResponseWriter, format nrdp.Format, total int, meta *nrdp.Meta, processErr error) {
+	meta.Output = fmt.Sprintf("%d checks processed.", meta.Accepted)
+	if len(meta.Rejected) > 0 {
+		meta.Output = fmt.Sprintf("%d checks processed, %d rejected.", meta.Accepted, len(meta.Rejected))
+	}
+
+	var resp nrdp.Response
+	code := http.StatusOK
+	switch {
+	case total == 0 || len(meta.Rejected) == 0:
+		resp = nrdp.OK("OK")
+	case meta.Accepted > 0:
+		resp = nrdp.OK("PARTIAL")
+	case errors.Is(processErr, check.ErrSpoolFull) || errors.Is(processErr, queue.ErrFull):
+		resp = nrdp.Error("SPOOL FULL, RETRY LATER")
+		if errors.Is(processErr, queue.ErrFull) {
+			resp = nrdp.Error("QUEUE FULL, RETRY LATER")
+		}
+		code = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(h.retryAfter))
+	case errors.Is(processErr, context.Canceled) || errors.Is(processErr, context.DeadlineExceeded):
+		resp = nrdp.Error("REQUEST CANCELLED")
+		code = http.StatusServiceUnavailable
+	case processErr != nil:
+		resp = nrdp.Error("FAILED TO PROCESS CHECK RESULTS")
+		code = http.StatusInternalServerError
+	default:
+		resp = nrdp.Error("NO VALID CHECK RESULTS")
+		code = http.StatusBadRequest
+	}
+	resp.Meta = meta
+	nrdp.Write(w, code, format, resp)
+}
+
+// handleSubmitCmd writes the posted external command to the Nagios command file
+func (h *Handler) handleSubmitCmd(w http.ResponseWriter, r *http.Request, format nrdp.Format) {
+	command := r.FormValue("command")
+	if command == "" {
+		logger.Logf(logger.LevelDebug, "Missing command in submitcmd request from %s", r.RemoteAddr)
+		nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("NO COMMAND"))
+		return
+	}
+
+	if h.commands == nil {
+		nrdp.Write(w, http.StatusServiceUnavailable, format, nrdp.Error("COMMAND FILE NOT CONFIGURED"))
+		return
+	}
+
+	if err := h.commands.Submit(command); err != nil {
+		if errors.Is(err, extcmd.ErrInvalidCommand) {
+			logger.Logf(logger.LevelDebug, "Invalid external command from %s: %q", r.RemoteAddr, command)
+			nrdp.Write(w, http.StatusBadRequest, format, nrdp.Error("BAD COMMAND"))
+			return
+		}
+		logger.Logf(logger.LevelInfo, "Failed to submit external command from %s: %v", r.RemoteAddr, err)
+		nrdp.Write(w, http.StatusInternalServerError, format, nrdp.Error("FAILED TO WRITE COMMAND"))
+		return
+	}
+
+	logger.Logf(logger.LevelInfo, "Submitted external command from %s: %s", r.RemoteAddr, command)
+	nrdp.Write(w, http.StatusOK, format, nrdp.OK("OK"))
+}
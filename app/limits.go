@@ -0,0 +1,124 @@
+package app
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/logger"
+	"nrdp_micro/metrics"
+	"nrdp_micro/nrdp"
+	"nrdp_micro/ratelimit"
+)
+
+// rateLimits holds the token buckets for each key listed in server.rate_limit.by.
+// A nil map means that limit is disabled.
+type rateLimits struct {
+	requests map[string]*ratelimit.Limiter
+	results  map[string]*ratelimit.Limiter
+	now      func() time.Time
+}
+
+// newRateLimits builds the request and result limiters from the configuration
+func (s *Server) newRateLimits() *rateLimits {
+	limit := s.cfg.Server.RateLimit
+	limits := &rateLimits{now: s.now}
+	if limit.RequestsPerSecond > 0 {
+		limits.requests = make(map[string]*ratelimit.Limiter)
+		for _, by := range limit.By {
+			limits.requests[by] = ratelimit.NewLimiter(limit.RequestsPerSecond, limit.RequestBurst)
+		}
+		logger.Logf(logger.LevelInfo, "Rate limiting requests to %g/s (burst %d) per %s", limit.RequestsPerSecond, limit.RequestBurst, strings.Join(limit.By, ", "))
+	}
+	if limit.ResultsPerSecond > 0 {
+		limits.results = make(map[string]*ratelimit.Limiter)
+		for _, by := range limit.By {
+			limits.results[by] = ratelimit.NewLimiter(limit.ResultsPerSecond, limit.ResultBurst)
+		}
+		logger.Logf(logger.LevelInfo, "Rate limiting check results to %g/s (burst %d) per %s", limit.ResultsPerSecond, limit.ResultBurst, strings.Join(limit.By, ", "))
+	}
+	return limits
+}
+
+// limitKeys are the keys of server.rate_limit.by in the order their limiters are applied
+var limitKeys = []string{"ip", "token"}
+
+// allow takes n events for the client from the limiters of the given kind ("requests" or
+// "results"), in the order of limitKeys. When a limit is exceeded it returns the events
+// already taken from the other limiters, writes the error response and returns false.
+func (l *rateLimits) allow(w http.ResponseWriter, format nrdp.Format, kind string, c client, n int) bool {
+	limiters := l.limiters(kind)
+	for _, by := range limitKeys {
+		if limiter, key := limiters[by], c.key(by); limiter != nil && key != "" && n > limiter.Burst() {
+			logger.Logf(logger.LevelInfo, "Rejected %d check results from %s: more than the rate limit burst of %d", n, c.ip, limiter.Burst())
+			metrics.ThrottledTotal.Inc(kind, by)
+			nrdp.Write(w, http.StatusRequestEntityTooLarge, format, nrdp.Error("TOO MANY CHECK RESULTS IN ONE REQUEST"))
+			return false
+		}
+	}
+
+	now := l.now()
+	var taken []string
+	for _, by := range limitKeys {
+		limiter, key := limiters[by], c.key(by)
+		if limiter == nil || key == "" {
+			continue // Not limited, or not known (yet) for this request
+		}
+		if ok, wait := limiter.AllowN(key, n, now); !ok {
+			for _, prev := range taken {
+				limiters[prev].Refund(c.key(prev), n)
+			}
+			logger.Logf(logger.LevelDebug, "Rate limited %s from %s (by %s), retry in %s", kind, c.ip, by, wait)
+			metrics.ThrottledTotal.Inc(kind, by)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			nrdp.Write(w, http.StatusTooManyRequests, format, nrdp.Error("RATE LIMIT EXCEEDED, RETRY LATER"))
+			return false
+		}
+		taken = append(taken, by)
+	}
+	return true
+}
+
+// refund returns n events taken by allow for the client, when the request was refused later
+func (l *rateLimits) refund(kind string, c client, n int) {
+	limiters := l.limiters(kind)
+	for _, by := range limitKeys {
+		if limiter, key := limiters[by], c.key(by); limiter != nil && key != "" {
+			limiter.Refund(key, n)
+		}
+	}
+}
+
+// limiters returns the limiters of the given kind by key
+func (l *rateLimits) limiters(kind string) map[string]*ratelimit.Limiter {
+	if kind == "results" {
+		return l.results
+	}
+	return l.requests
+}
+
+// key returns what the client is limited by for the given rate_limit.by entry
+func (c client) key(by string) string {
+	if by == "token" {
+		return c.token
+	}
+	return c.ip
+}
+
+// collect writes how many distinct clients were throttled in the last minute
+func (l *rateLimits) collect(w io.Writer) {
+	const name = "nrdp_throttled_clients"
+	metrics.WriteHeader(w, name, "Distinct clients refused by a rate limit in the last minute, by limit and key.", "gauge")
+	since := l.now().Add(-time.Minute)
+	for _, kind := range []string{"requests", "results"} {
+		limiters := l.limiters(kind)
+		for _, by := range limitKeys {
+			if limiter, ok := limiters[by]; ok {
+				metrics.WriteSample(w, name, []metrics.Label{{Name: "limit", Value: kind}, {Name: "by", Value: by}}, float64(limiter.Limited(since)))
+			}
+		}
+	}
+}
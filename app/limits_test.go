@@ -0,0 +1,174 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLimitedServer builds a test server limiting requests to a burst of two per key
+// listed in by, on a clock that stands still so buckets never refill
+func newLimitedServer(t *testing.T, by ...string) *Server {
+	t.Helper()
+	opts, _ := testOptions(t)
+	opts.Config.Server.Tokens = append(opts.Config.Server.Tokens, opts.Config.Server.Tokens[0])
+	opts.Config.Server.Tokens[1].Token = "other"
+	limit := &opts.Config.Server.RateLimit
+	limit.By = by
+	limit.RequestsPerSecond = 1
+	limit.RequestBurst = 2
+	now := time.Unix(1700000000, 0)
+	opts.Clock = func() time.Time { return now }
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv
+}
+
+func hello(t *testing.T, srv *Server, remoteAddr string) int {
+	t.Helper()
+	code, _ := postFrom(t, srv, remoteAddr, url.Values{"cmd": {"hello"}})
+	return code
+}
+
+func TestRateLimitSkipsClientsWithoutAddress(t *testing.T) {
+	srv := newLimitedServer(t, "ip")
+
+	// Unparseable addresses do not share one bucket
+	for i := 0; i < 5; i++ {
+		if code := hello(t, srv, "@unix"); code != http.StatusOK {
+			t.Fatalf("request %d without an address = %d, want 200", i, code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if code := hello(t, srv, "192.0.2.1:1234"); code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i, code)
+		}
+	}
+	if code := hello(t, srv, "192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst = %d, want 429", code)
+	}
+}
+
+// submit posts an empty submitcheck with the token, which passes the rate limits
+// before failing with 400 for the missing data
+func submit(t *testing.T, srv *Server, remoteAddr, token string) int {
+	t.Helper()
+	code, _ := postFrom(t, srv, remoteAddr, url.Values{"cmd": {"submitcheck"}, "token": {token}})
+	return code
+}
+
+func TestRateLimitRefusalChargesNoOtherKey(t *testing.T) {
+	srv := newLimitedServer(t, "token", "ip")
+	steps := []struct {
+		addr, token string
+		want        int
+	}{
+		{"192.0.2.1:1", "secret", http.StatusBadRequest},
+		{"192.0.2.2:1", "secret", http.StatusBadRequest},
+		{"192.0.2.1:1", "secret", http.StatusTooManyRequests}, // Token exhausted, the address is not charged
+		{"192.0.2.1:1", "other", http.StatusBadRequest},       // So the address has one request left
+		{"192.0.2.1:1", "other", http.StatusTooManyRequests},  // Address exhausted, the token is not charged
+		{"192.0.2.3:1", "other", http.StatusBadRequest},       // So the token has one request left
+		{"192.0.2.4:1", "other", http.StatusTooManyRequests},
+	}
+	for i, step := range steps {
+		if code := submit(t, srv, step.addr, step.token); code != step.want {
+			t.Fatalf("step %d from %s with %s = %d, want %d", i, step.addr, step.token, code, step.want)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	opts, _ := testOptions(t)
+	opts.Config.Server.MetricsPath = "/metrics"
+	opts.Config.Server.TrustedProxies = []string{"10.0.0.1/32"}
+	opts.Config.Server.Access.Allow = []string{"192.0.2.0/24"}
+	opts.Config.Server.Access.Deny = []string{"192.0.2.128/25"}
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Stop(context.Background())
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"allowed", "/", "192.0.2.1:1234", "", http.StatusOK},
+		{"not in allow list", "/", "198.51.100.1:1234", "", http.StatusForbidden},
+		{"deny list wins", "/", "192.0.2.200:1234", "", http.StatusForbidden},
+		{"allowed behind proxy", "/", "10.0.0.1:1234", "192.0.2.1", http.StatusOK},
+		{"denied behind proxy", "/", "10.0.0.1:1234", "192.0.2.200", http.StatusForbidden},
+		{"header from untrusted client", "/", "198.51.100.1:1234", "192.0.2.1", http.StatusForbidden},
+		{"metrics allowed", "/metrics", "192.0.2.1:1234", "", http.StatusOK},
+		{"metrics denied", "/metrics", "192.0.2.200:1234", "", http.StatusForbidden},
+		{"liveness stays open", "/healthz", "198.51.100.1:1234", "", http.StatusOK},
+		{"readiness stays open", "/readyz", "192.0.2.200:1234", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.path == "/" {
+				req = httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("cmd=hello"))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s from %s = %d, want %d", tt.path, tt.remoteAddr, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultRateLimit(t *testing.T) {
+	opts, sink := testOptions(t)
+	limit := &opts.Config.Server.RateLimit
+	limit.By = []string{"token"}
+	limit.ResultsPerSecond = 1
+	limit.ResultBurst = 3
+	now := time.Unix(1700000000, 0)
+	opts.Clock = func() time.Time { return now }
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Stop(context.Background())
+
+	submitResults := func(n int) int {
+		var results []string
+		for i := 0; i < n; i++ {
+			results = append(results, `{"checkresult": {"type": "host"}, "hostname": "web01", "state": 0, "output": "UP"}`)
+		}
+		jsonData := `{"checkresults": [` + strings.Join(results, ",") + `]}`
+		code, _ := post(t, srv, url.Values{"cmd": {"submitcheck"}, "token": {"secret"}, "JSONDATA": {jsonData}})
+		return code
+	}
+	if code := submitResults(2); code != http.StatusOK {
+		t.Fatalf("2 results = %d, want 200", code)
+	}
+	// Two more would exceed the burst of three, so the whole submission is refused
+	if code := submitResults(2); code != http.StatusTooManyRequests {
+		t.Fatalf("2 more results = %d, want 429", code)
+	}
+	if code := submitResults(1); code != http.StatusOK {
+		t.Fatalf("the last result = %d, want 200", code)
+	}
+	if results := sink.Results(); len(results) != 3 {
+		t.Errorf("sink received %d results, want 3", len(results))
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+)
+
+// Token is an accepted NRDP token and the hosts its holder may submit for
+type Token struct {
+	Value      string
+	Hosts      []string // Hostname patterns the token may submit for, empty allows any host
+	HostPrefix string   // Prepended to every hostname submitted with the token
+}
+
+// Tokens holds the set of tokens accepted by the NRDP endpoint
+type Tokens struct {
+	hashes [][sha256.Size]byte
+	scopes []*Scope
+}
+
+// NewTokens creates a token set from the configured tokens.
+// Tokens with an empty value are ignored.
+func NewTokens(tokens []Token) (*Tokens, error) {
+	t := &Tokens{}
+	for i, token := range tokens {
+		if token.Value == "" {
+			continue
+		}
+		scope := &Scope{HostPrefix: token.HostPrefix}
+		if len(token.Hosts) > 0 {
+			hosts, err := NewHostPatterns(token.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("token %d: %v", i, err)
+			}
+			scope = scope.Restrict(hosts)
+		}
+		t.hashes = append(t.hashes, sha256.Sum256([]byte(token.Value)))
+		t.scopes = append(t.scopes, scope)
+	}
+	return t, nil
+}
+
+// Enabled reports whether token authentication is configured
+func (t *Tokens) Enabled() bool {
+	return t != nil && len(t.hashes) > 0
+}
+
+// Lookup returns the scope of the supplied token, or false if it matches no configured token.
+// Tokens are hashed first so the comparison does not leak their length, and every
+// configured token is compared so the timing does not reveal which one matched.
+func (t *Tokens) Lookup(token string) (*Scope, bool) {
+	if !t.Enabled() || token == "" {
+		return nil, false
+	}
+	supplied := sha256.Sum256([]byte(token))
+	found := -1
+	for i := range t.hashes {
+		match := subtle.ConstantTimeCompare(supplied[:], t.hashes[i][:])
+		found = subtle.ConstantTimeSelect(match, i, found)
+	}
+	if found < 0 {
+		return nil, false
+	}
+	return t.scopes[found], true
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// HostPatterns restricts the hostnames a client may submit results for.
+// Patterns are shell globs ("web-*.example.com") or, when wrapped in slashes,
+// regular expressions ("/^db-[0-9]+$/") matched against the whole hostname.
+type HostPatterns struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// NewHostPatterns compiles the given patterns
+func NewHostPatterns(patterns []string) (*HostPatterns, error) {
+	p := &HostPatterns{}
+	for _, pattern := range patterns {
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %s: %v", pattern, err)
+			}
+			p.regexps = append(p.regexps, re)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %s: %v", pattern, err)
+		}
+		p.globs = append(p.globs, pattern)
+	}
+	return p, nil
+}
+
+// Match reports whether the hostname matches any of the patterns
+func (p *HostPatterns) Match(hostname string) bool {
+	for _, glob := range p.globs {
+		if ok, _ := path.Match(glob, hostname); ok {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// union returns patterns matching hostnames matched by either p or o
+func (p *HostPatterns) union(o *HostPatterns) *HostPatterns {
+	if p == nil {
+		return o
+	}
+	return &HostPatterns{
+		globs:   append(append([]string(nil), p.globs...), o.globs...),
+		regexps: append(append([]*regexp.Regexp(nil), p.regexps...), o.regexps...),
+	}
+}
+
+// ClientHosts maps TLS client certificate identities to the hosts those clients may submit for
+type ClientHosts struct {
+	identities map[string]*HostPatterns
+}
+
+// NewClientHosts creates the mapping from certificate identity (common name or DNS
+// subject alternative name) to host patterns
+func NewClientHosts(mapping map[string][]string) (*ClientHosts, error) {
+	c := &ClientHosts{identities: make(map[string]*HostPatterns, len(mapping))}
+	for identity, patterns := range mapping {
+		hosts, err := NewHostPatterns(patterns)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %v", identity, err)
+		}
+		c.identities[strings.ToLower(identity)] = hosts
+	}
+	return c, nil
+}
+
+// Enabled reports whether any client certificate mappings are configured
+func (c *ClientHosts) Enabled() bool {
+	return c != nil && len(c.identities) > 0
+}
+
+// ForCertificate returns the hosts the certificate holder may submit for, combining the
+// entries for its common name and every DNS name. ok is false when no entry matches.
+func (c *ClientHosts) ForCertificate(cert *x509.Certificate) (hosts *HostPatterns, ok bool) {
+	if !c.Enabled() || cert == nil {
+		return nil, false
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		if patterns, found := c.identities[strings.ToLower(name)]; found {
+			hosts = hosts.union(patterns)
+		}
+	}
+	return hosts, hosts != nil
+}
+
+// Scope limits the hostnames a client may submit results for. A nil Scope is unrestricted.
+type Scope struct {
+	HostPrefix string          // Prepended to submitted hostnames that do not already start with it
+	hosts      []*HostPatterns // The prefixed hostname must match every one of these
+}
+
+// Restrict returns a copy of the scope that additionally requires hostnames to match hosts
+func (s *Scope) Restrict(hosts *HostPatterns) *Scope {
+	restricted := &Scope{}
+	if s != nil {
+		restricted.HostPrefix = s.HostPrefix
+		restricted.hosts = append(restricted.hosts, s.hosts...)
+	}
+	restricted.hosts = append(restricted.hosts, hosts)
+	return restricted
+}
+
+// Restricted reports whether the scope limits or rewrites hostnames at all
+func (s *Scope) Restricted() bool {
+	return s != nil && (s.HostPrefix != "" || len(s.hosts) > 0)
+}
+
+// Hostname applies the forced prefix to a submitted hostname and returns the resulting
+// name, or an error if the client may not submit for it
+func (s *Scope) Hostname(hostname string) (string, error) {
+	if s == nil {
+		return hostname, nil
+	}
+	if s.HostPrefix != "" && !strings.HasPrefix(hostname, s.HostPrefix) {
+		hostname = s.HostPrefix + hostname
+	}
+	for _, hosts := range s.hosts {
+		if !hosts.Match(hostname) {
+			return "", fmt.Errorf("not authorized to submit for host %s", hostname)
+		}
+	}
+	return hostname, nil
+}
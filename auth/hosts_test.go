@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+
+	"nrdp_micro/check"
+)
+
+// The scope alone cannot be trusted with hostnames containing line breaks, as path.Match
+// lets '*' match them; results must be validated before the scope is applied.
+func TestScopeRejectsInjectedHostnames(t *testing.T) {
+	hosts, err := NewHostPatterns([]string{"team-a-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := (*Scope)(nil).Restrict(hosts)
+
+	tests := []struct {
+		name    string
+		result  check.Result
+		allowed bool
+	}{
+		{"own host", check.Result{HostName: "team-a-web"}, true},
+		{"own service", check.Result{HostName: "team-a-web", ServiceName: "HTTP"}, true},
+		{"other tenant", check.Result{HostName: "team-b-db"}, false},
+		{"hostname injection", check.Result{HostName: "team-a-x\n\nhost_name=team-b-db"}, false},
+		{"servicename injection", check.Result{HostName: "team-a-web", ServiceName: "HTTP\n\nhost_name=team-b-db"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.result.Validate()
+			if err == nil {
+				_, err = scope.Hostname(tt.result.HostName)
+			}
+			if (err == nil) != tt.allowed {
+				t.Errorf("allowed = %v, want %v (err %v)", err == nil, tt.allowed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks is a list of CIDR ranges
+type Networks []*net.IPNet
+
+// ParseNetworks parses CIDR ranges; plain addresses are taken as single-host ranges
+func ParseNetworks(cidrs []string) (Networks, error) {
+	var networks Networks
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains reports whether ip is in any of the ranges
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkPolicy decides which source addresses may use the endpoint.
+// Denied ranges take precedence; with an empty allow list every other address is allowed.
+type NetworkPolicy struct {
+	Allow Networks
+	Deny  Networks
+}
+
+// Allowed reports whether requests from ip are permitted. A nil ip, as for requests over
+// a unix socket or an in-memory listener, is only allowed when no lists are configured.
+func (p NetworkPolicy) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(p.Allow) == 0 && len(p.Deny) == 0
+	}
+	if p.Deny.Contains(ip) {
+		return false
+	}
+	return len(p.Allow) == 0 || p.Allow.Contains(ip)
+}
+
+// ClientIP returns the address of the client that sent the request. X-Forwarded-For is
+// only honoured when the connection comes from a trusted proxy; the header is then read
+// from right to left, skipping further trusted proxies, so a client cannot choose its
+// address by sending its own header.
+func ClientIP(r *http.Request, trustedProxies Networks) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxies.Contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
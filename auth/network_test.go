@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkPolicyAllowed(t *testing.T) {
+	networks := func(cidrs ...string) Networks {
+		n, err := ParseNetworks(cidrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tests := []struct {
+		name   string
+		policy NetworkPolicy
+		ip     net.IP
+		want   bool
+	}{
+		{"no lists", NetworkPolicy{}, net.ParseIP("192.0.2.1"), true},
+		{"no lists, no address", NetworkPolicy{}, nil, true},
+		{"allowed", NetworkPolicy{Allow: networks("192.0.2.0/24")}, net.ParseIP("192.0.2.1"), true},
+		{"not allowed", NetworkPolicy{Allow: networks("192.0.2.0/24")}, net.ParseIP("198.51.100.1"), false},
+		{"allow list, no address", NetworkPolicy{Allow: networks("192.0.2.0/24")}, nil, false},
+		{"denied", NetworkPolicy{Deny: networks("192.0.2.1")}, net.ParseIP("192.0.2.1"), false},
+		{"deny list, no address", NetworkPolicy{Deny: networks("192.0.2.1")}, nil, false},
+		{"deny wins", NetworkPolicy{Allow: networks("192.0.2.0/24"), Deny: networks("192.0.2.1")}, net.ParseIP("192.0.2.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allowed(tt.ip); got != tt.want {
+				t.Errorf("Allowed(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package batcher coalesces items written by concurrent callers into batches, so a
+// destination that is cheaper to write in bulk, such as the spool or the status database,
+// is written once per batch instead of once per caller.
+package batcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"nrdp_micro/logger"
+)
+
+// ErrClosed is returned when adding to a batcher that has been closed
+var ErrClosed = errors.New("batcher is closed")
+
+// Batcher collects items across Add calls and passes them to its write function in
+// batches of up to maxItems, or after maxDelay, whichever comes first. Each Add blocks
+// until the batch holding its items has been written and returns that batch's error.
+type Batcher[T any] struct {
+	name     string // What the items are, for log messages
+	write    func(items []T) error
+	maxItems int
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending []*call[T]
+	count   int // Items in pending
+	timer   *time.Timer
+	closed  bool
+}
+
+// call is the items of one Add and the channel receiving the outcome of their batch
+type call[T any] struct {
+	items []T
+	done  chan error
+}
+
+// New creates a batcher passing batches to write. name describes the items in log messages.
+func New[T any](name string, write func(items []T) error, maxItems int, maxDelay time.Duration) *Batcher[T] {
+	if maxItems < 1 {
+		maxItems = 1
+	}
+	return &Batcher[T]{
+		name:     name,
+		write:    write,
+		maxItems: maxItems,
+		maxDelay: maxDelay,
+	}
+}
+
+// Add queues the items for the next batch and waits for it to be written.
+// If ctx is cancelled before the batch is taken for writing, the items are removed from
+// it and ctx.Err() is returned. Once the batch is being written Add waits for the
+// outcome, so an error always means the items were not written.
+func (b *Batcher[T]) Add(ctx context.Context, items []T) error {
+	if len(items) == 0 {
+		return nil
+	}
+	c := &call[T]{items: items, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.pending = append(b.pending, c)
+	b.count += len(items)
+	if b.count >= b.maxItems {
+		batch := b.takeLocked()
+		b.mu.Unlock()
+		b.flush(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.maxDelay, b.flushPending)
+		}
+		b.mu.Unlock()
+	}
+
+	select {
+	case err := <-c.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	for i, pending := range b.pending {
+		if pending == c {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			b.count -= len(items)
+			if len(b.pending) == 0 && b.timer != nil {
+				b.timer.Stop()
+				b.timer = nil
+			}
+			b.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	b.mu.Unlock()
+	// Already taken for writing
+	return <-c.done
+}
+
+// Close writes any pending items and refuses further ones
+func (b *Batcher[T]) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	batch := b.takeLocked()
+	b.mu.Unlock()
+
+	return b.flush(batch)
+}
+
+// flushPending is called by the timer to write whatever has accumulated
+func (b *Batcher[T]) flushPending() {
+	b.mu.Lock()
+	batch := b.takeLocked()
+	b.mu.Unlock()
+	b.flush(batch)
+}
+
+// takeLocked removes the pending calls. Must be called with mu held.
+func (b *Batcher[T]) takeLocked() []*call[T] {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending, b.count = nil, 0
+	return batch
+}
+
+// flush writes the items of the calls as one batch and reports the outcome to each of them
+func (b *Batcher[T]) flush(calls []*call[T]) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	var batch []T
+	for _, c := range calls {
+		batch = append(batch, c.items...)
+	}
+	err := b.write(batch)
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "batch of %d %s from %d writes failed: %v", len(batch), b.name, len(calls), err)
+	} else {
+		logger.Logf(logger.LevelTrace, "wrote batch of %d %s from %d writes", len(batch), b.name, len(calls))
+	}
+	for _, c := range calls {
+		c.done <- err
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a write function that records the batches it is given
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]int
+}
+
+func (r *recorder) write(items []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, slices.Clone(items))
+	return nil
+}
+
+func (r *recorder) Batches() [][]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batches
+}
+
+// waitPending waits until the batcher holds n pending items
+func waitPending(b *Batcher[int], n int) {
+	for {
+		b.mu.Lock()
+		count := b.count
+		b.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatcherWritesFullBatch(t *testing.T) {
+	rec := &recorder{}
+	b := New("items", rec.write, 3, time.Hour)
+
+	errs := make(chan error, 1)
+	go func() { errs <- b.Add(context.Background(), []int{1, 2}) }()
+	waitPending(b, 2) // So the order within the batch is known
+	if err := b.Add(context.Background(), []int{3}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if got := rec.Batches(); len(got) != 1 || !slices.Equal(got[0], []int{1, 2, 3}) {
+		t.Errorf("batches = %v, want [[1 2 3]]", got)
+	}
+}
+
+func TestBatcherWritesAfterDelay(t *testing.T) {
+	rec := &recorder{}
+	b := New("items", rec.write, 100, time.Millisecond)
+	if err := b.Add(context.Background(), []int{1}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if got := rec.Batches(); len(got) != 1 || !slices.Equal(got[0], []int{1}) {
+		t.Errorf("batches = %v, want [[1]]", got)
+	}
+}
+
+func TestBatcherCancelRemovesPendingItems(t *testing.T) {
+	rec := &recorder{}
+	b := New("items", rec.write, 100, time.Hour)
+
+	kept := make(chan error, 1)
+	go func() { kept <- b.Add(context.Background(), []int{1}) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- b.Add(ctx, []int{2, 3}) }()
+	waitPending(b, 3)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled Add = %v, want context.Canceled", err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := <-kept; err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if got := rec.Batches(); len(got) != 1 || !slices.Equal(got[0], []int{1}) {
+		t.Errorf("batches = %v, want only the items of the call that was not cancelled", got)
+	}
+}
+
+func TestBatcherCancelDuringWriteWaitsForOutcome(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	b := New("items", func(items []int) error {
+		close(started)
+		<-release
+		return nil
+	}, 100, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- b.Add(ctx, []int{1}) }()
+
+	<-started
+	cancel()
+	select {
+	case err := <-errs:
+		t.Fatalf("Add returned %v while its batch was being written", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Errorf("Add = %v, want nil as the items were written", err)
+	}
+}
+
+func TestBatcherClosed(t *testing.T) {
+	b := New("items", (&recorder{}).write, 10, time.Hour)
+	b.Close()
+	if err := b.Add(context.Background(), []int{1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package bench generates NRDP load: simulated hosts post their service results at a
+// target rate and the latency, status codes and throughput are reported, to find how
+// many results per second an instance sustains before the spool or database throttles.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/client"
+)
+
+// Options configures a benchmark run
+type Options struct {
+	Client      client.Options // Target server; Retries and BatchSize are ignored
+	Hosts       int            // Simulated hosts
+	Services    int            // Services per host, each request carries one host's results
+	Rate        float64        // Target check results per second across all hosts
+	Duration    time.Duration  // How long to generate load
+	Concurrency int            // Maximum requests in flight
+}
+
+// Report summarizes a benchmark run
+type Report struct {
+	Elapsed         time.Duration
+	Requests        int            // Requests completed
+	Missed          int            // Requests not sent on schedule because all workers were busy
+	StatusCodes     map[string]int // HTTP status code, or "error" for network errors, -> requests
+	ResultsSent     int
+	ResultsAccepted int
+	ResultsRejected int
+	Latencies       []time.Duration // Sorted request latencies
+}
+
+// Validate checks the options for a run
+func (o Options) Validate() error {
+	if o.Hosts < 1 {
+		return errors.New("hosts must be at least 1")
+	}
+	if o.Services < 1 {
+		return errors.New("services must be at least 1")
+	}
+	if o.Rate <= 0 {
+		return errors.New("rate must be greater than 0")
+	}
+	if o.Duration <= 0 {
+		return errors.New("duration must be greater than 0")
+	}
+	if o.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	return nil
+}
+
+// Run generates load until the duration has passed or ctx is cancelled, then waits for
+// the requests in flight and returns the report. Requests are scheduled open-loop at
+// Rate/Services per second, cycling through the hosts, so a slow server shows up as
+// latency and missed requests instead of silently lowering the offered load.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	clientOpts := opts.Client
+	clientOpts.Retries = 0
+	clientOpts.BatchSize = 0
+	c, err := client.New(clientOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(float64(time.Second) * float64(opts.Services) / opts.Rate)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+
+	report := &Report{StatusCodes: make(map[string]int)}
+	var mu sync.Mutex
+	jobs := make(chan int) // Unbuffered: a send only succeeds when a worker is idle
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range jobs {
+				results := hostResults(host, opts.Services)
+				start := time.Now()
+				resp, err := c.SubmitResults(context.Background(), results)
+				latency := time.Since(start)
+
+				mu.Lock()
+				report.Requests++
+				report.ResultsSent += len(results)
+				report.Latencies = append(report.Latencies, latency)
+				report.StatusCodes[statusCode(err)]++
+				var serverErr *client.Error
+				if errors.As(err, &serverErr) {
+					resp = serverErr.Response // Lists the rejections when none were accepted
+				}
+				if resp.Meta != nil {
+					report.ResultsAccepted += resp.Meta.Accepted
+					report.ResultsRejected += len(resp.Meta.Rejected)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Tick at most every millisecond and send however many requests are due by then,
+	// so rates beyond the timer resolution are still met
+	tick := interval
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	runCtx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	begin := time.Now()
+	scheduled, next := 0, 0
+	for running := true; running; {
+		select {
+		case <-runCtx.Done():
+			running = false
+			continue
+		case <-ticker.C:
+		}
+		for due := int(time.Since(begin) / interval); scheduled < due; scheduled++ {
+			select {
+			case jobs <- next:
+				next = (next + 1) % opts.Hosts
+			default:
+				report.Missed++
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	report.Elapsed = time.Since(begin)
+
+	sort.Slice(report.Latencies, func(i, j int) bool { return report.Latencies[i] < report.Latencies[j] })
+	return report, nil
+}
+
+// hostResults builds the service results one simulated host sends per request, with
+// varying states and performance data so the server parses and stores realistic data
+func hostResults(host, services int) []check.Result {
+	now := time.Now().Unix()
+	hostname := fmt.Sprintf("bench-host-%04d", host)
+	results := make([]check.Result, 0, services)
+	for i := 0; i < services; i++ {
+		value := int((now + int64(host*services+i)) % 100)
+		state := 0
+		switch {
+		case value >= 90:
+			state = 2
+		case value >= 80:
+			state = 1
+		}
+		result := client.ServiceResult(hostname, fmt.Sprintf("bench-service-%03d", i), state,
+			fmt.Sprintf("%s - load %d%%|load=%d%%;80;90;0;100", check.StateLabel(state), value, value))
+		result.Time = now
+		results = append(results, result)
+	}
+	return results
+}
+
+// statusCode returns the report key for the outcome of a request
+func statusCode(err error) string {
+	if err == nil {
+		return strconv.Itoa(http.StatusOK)
+	}
+	var serverErr *client.Error
+	if errors.As(err, &serverErr) {
+		return strconv.Itoa(serverErr.StatusCode)
+	}
+	return "error"
+}
+
+// Percentile returns the latency below which the given fraction (0-1) of requests completed
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// ResultsPerSecond returns the accepted check results per second
+func (r *Report) ResultsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.ResultsAccepted) / r.Elapsed.Seconds()
+}
+
+// Print writes the report in a human readable form
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Duration:          %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Requests:          %d (%.1f/s), %d missed schedule\n", r.Requests, float64(r.Requests)/r.Elapsed.Seconds(), r.Missed)
+	fmt.Fprintf(w, "Results sent:      %d\n", r.ResultsSent)
+	fmt.Fprintf(w, "Results accepted:  %d (%.1f/s)\n", r.ResultsAccepted, r.ResultsPerSecond())
+	fmt.Fprintf(w, "Results rejected:  %d\n", r.ResultsRejected)
+
+	codes := make([]string, 0, len(r.StatusCodes))
+	for code := range r.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "Status codes:\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %-6s %d\n", code, r.StatusCodes[code])
+	}
+
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(w, "Latency:\n")
+		for _, p := range []struct {
+			name  string
+			value float64
+		}{{"p50", .5}, {"p90", .9}, {"p99", .99}, {"p99.9", .999}} {
+			fmt.Fprintf(w, "  %-6s %s\n", p.name, r.Percentile(p.value).Round(time.Microsecond))
+		}
+		fmt.Fprintf(w, "  %-6s %s\n", "max", r.Latencies[len(r.Latencies)-1].Round(time.Microsecond))
+	}
+}
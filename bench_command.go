@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"nrdp_micro/app"
+	"nrdp_micro/bench"
+	"nrdp_micro/config"
+	"nrdp_micro/logger"
+)
+
+// runBench implements "nrdp_micro bench": it generates load against a running instance
+// given with -url, or against an in-process server built from -config, and prints the report.
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var (
+		opts       bench.Options
+		configFile string
+		useStorage bool
+		insecure   bool
+	)
+	flags.StringVar(&opts.Client.URL, "url", "", "NRDP URL of a running instance")
+	flags.StringVar(&configFile, "config", "", "Run an in-process server with this configuration instead of -url")
+	flags.BoolVar(&useStorage, "use-config-storage", false, "With -config, write to the configured spool, database and sinks instead of a temporary directory")
+	flags.StringVar(&opts.Client.Token, "token", "", "NRDP token, defaults to the first configured token with -config")
+	flags.StringVar(&opts.Client.Format, "format", "xml", "Submission format: xml or json")
+	flags.DurationVar(&opts.Client.Timeout, "timeout", 10*time.Second, "Request timeout")
+	flags.BoolVar(&insecure, "insecure", false, "Do not verify the server certificate")
+	flags.IntVar(&opts.Hosts, "hosts", 100, "Simulated hosts")
+	flags.IntVar(&opts.Services, "services", 10, "Services per host, sent together in one request")
+	flags.Float64Var(&opts.Rate, "rate", 1000, "Target check results per second")
+	flags.DurationVar(&opts.Duration, "duration", 30*time.Second, "How long to generate load")
+	flags.IntVar(&opts.Concurrency, "concurrency", 32, "Maximum requests in flight")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if insecure {
+		opts.Client.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if (opts.Client.URL == "") == (configFile == "") {
+		fmt.Fprintln(os.Stderr, "bench: exactly one of -url and -config must be given")
+		return 2
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 2
+	}
+
+	// Server and client log lines go to stderr so the report on stdout stays readable
+	logger.Configure(logger.LevelInfo, log.New(os.Stderr, "", log.Ldate|log.Ltime))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if configFile != "" {
+		shutdown, err := startBenchServer(configFile, useStorage, &opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 1
+		}
+		defer shutdown()
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending %g results/s as %d hosts x %d services to %s for %s...\n",
+		opts.Rate, opts.Hosts, opts.Services, opts.Client.URL, opts.Duration)
+	report, err := bench.Run(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+	report.Print(os.Stdout)
+	return 0
+}
+
+// startBenchServer starts the server from the configuration without its own listener,
+// serves it on an ephemeral loopback port and points the benchmark at it. The simulated
+// hosts never reach the Nagios object config; unless useStorage is set, the spool,
+// database and queue are moved to a temporary directory that is removed on shutdown,
+// and results are only written to that spool.
+func startBenchServer(configFile string, useStorage bool, opts *bench.Options) (shutdown func(), err error) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %v", err)
+	}
+	logger.Configure(logger.ParseLevel(cfg.Logging.Level), log.New(os.Stderr, "", log.Ldate|log.Ltime))
+
+	scratchDir := ""
+	if !useStorage {
+		scratchDir, err = useScratchStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	removeScratch := func() {
+		if scratchDir != "" {
+			os.RemoveAll(scratchDir)
+		}
+	}
+
+	server, err := app.NewServer(app.Options{Config: *cfg, DisableNagiosConfig: true})
+	if err != nil {
+		removeScratch()
+		return nil, err
+	}
+	if err := server.Start(); err != nil {
+		server.Stop(context.Background())
+		removeScratch()
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.Stop(context.Background())
+		removeScratch()
+		return nil, err
+	}
+	httpServer := &http.Server{Handler: server}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logf(logger.LevelInfo, "Benchmark server failed: %v", err)
+		}
+	}()
+
+	opts.Client.URL = "http://" + listener.Addr().String() + "/"
+	if opts.Client.Token == "" && len(cfg.Server.Tokens) > 0 {
+		opts.Client.Token = cfg.Server.Tokens[0].Token
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+		if err := server.Stop(ctx); err != nil {
+			logger.Logf(logger.LevelInfo, "Shutdown: %v", err)
+		}
+		removeScratch()
+	}, nil
+}
+
+// useScratchStorage points the spool, database and queue of cfg at a new temporary
+// directory and limits the sinks to the spool, so no fake results reach Nagios, its
+// command file or a perfdata endpoint. It returns the directory.
+func useScratchStorage(cfg *config.Config) (string, error) {
+	dir, err := os.MkdirTemp("", "nrdp-bench-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	spoolDir := filepath.Join(dir, "spool")
+	if err := os.Mkdir(spoolDir, 0770); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to create scratch spool directory: %v", err)
+	}
+	cfg.Storage.OutputDir = spoolDir
+	cfg.Storage.Sinks = []string{"spool"}
+	cfg.DatabasePath = filepath.Join(dir, "status.db")
+	cfg.Queue.Dir = filepath.Join(dir, "queue")
+	logger.Logf(logger.LevelInfo, "Benchmark spool, database and queue are in %s", dir)
+	return dir, nil
+}
@@ -0,0 +1,43 @@
+package check
+
+import (
+	"context"
+	"time"
+
+	"nrdp_micro/batcher"
+)
+
+// ErrSinkClosed is returned when writing to a sink that has been closed
+var ErrSinkClosed = batcher.ErrClosed
+
+// BatchingSink collects results across Write calls and passes them to the wrapped sink
+// in batches of up to MaxResults, or after MaxDelay, whichever comes first.
+// Each Write blocks until the batch holding its results has been written and
+// returns that batch's error.
+type BatchingSink struct {
+	sink    Sink
+	batcher *batcher.Batcher[Result]
+}
+
+// NewBatchingSink wraps sink so results are written in batches
+func NewBatchingSink(sink Sink, maxResults int, maxDelay time.Duration) *BatchingSink {
+	return &BatchingSink{
+		sink: sink,
+		batcher: batcher.New("results", func(batch []Result) error {
+			// The batch mixes results from several requests, so it is not bound to any one request's context
+			return sink.Write(context.Background(), batch)
+		}, maxResults, maxDelay),
+	}
+}
+
+// Write queues the results for the next batch and waits for it to be written.
+// If ctx is cancelled before the batch is written the results are left out of it.
+func (b *BatchingSink) Write(ctx context.Context, results []Result) error {
+	return b.batcher.Add(ctx, results)
+}
+
+// Close writes any pending results and closes the wrapped sink
+func (b *BatchingSink) Close() error {
+	b.batcher.Close()
+	return b.sink.Close()
+}
@@ -1,28 +1,74 @@
 package check
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
-	"math/rand"
-	"os"
-	"os/user"
-	"path/filepath"
-	"strconv"
 	"strings"
-	"time"
+	"unicode"
 
 	"nrdp_micro/logger"
-	"nrdp_micro/storage"
+)
+
+// Result types sent in the checkresult type attribute
+const (
+	TypeHost    = "host"
+	TypeService = "service"
+)
+
+// Nagios check types, as used in the checktype attribute and the check_type spool field
+const (
+	CheckTypeActive  = 0
+	CheckTypePassive = 1
 )
 
 // Result represents a single check result
 type Result struct {
 	XMLName     xml.Name `xml:"checkresult"`
+	Type        string   `xml:"type,attr"`      // "host" or "service", inferred from ServiceName when empty
+	CheckType   string   `xml:"checktype,attr"` // "0" active or "1" passive, passive when empty
 	HostName    string   `xml:"hostname"`
 	ServiceName string   `xml:"servicename"`
 	State       int      `xml:"state"`
 	Output      string   `xml:"output"`
 	Time        int64    `xml:"time"`
+	Parsed      *Output  `xml:"-"` // Text and performance data split from Output, see PluginOutput
+}
+
+// UnmarshalXML decodes a checkresult, also accepting checktype as a child element
+// as sent by some NRDP clients.
+func (r *Result) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Plain Result // prevents recursion into UnmarshalXML; exported so encoding/xml can fill it
+	var aux struct {
+		Plain
+		CheckTypeElement string `xml:"checktype"`
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	*r = Result(aux.Plain)
+	if r.CheckType == "" {
+		r.CheckType = aux.CheckTypeElement
+	}
+	r.Type = strings.ToLower(strings.TrimSpace(r.Type))
+	r.CheckType = strings.TrimSpace(r.CheckType)
+	return nil
+}
+
+// IsHost reports whether the result is a host check result
+func (r Result) IsHost() bool {
+	if r.Type != "" {
+		return r.Type == TypeHost
+	}
+	return r.ServiceName == ""
+}
+
+// NagiosCheckType returns the Nagios check_type for the result, defaulting to passive
+func (r Result) NagiosCheckType() int {
+	if r.CheckType == "0" {
+		return CheckTypeActive
+	}
+	return CheckTypePassive
 }
 
 // Results represents a collection of check results
@@ -31,6 +77,66 @@ type Results struct {
 	CheckResult []Result `xml:"checkresult"`
 }
 
+// Validate checks that the result can be handed to Nagios
+func (r Result) Validate() error {
+	if strings.TrimSpace(r.HostName) == "" {
+		return fmt.Errorf("missing hostname")
+	}
+	if err := validateName("hostname", r.HostName); err != nil {
+		return err
+	}
+	if err := validateName("servicename", r.ServiceName); err != nil {
+		return err
+	}
+	switch r.Type {
+	case "", TypeHost, TypeService:
+	default:
+		return fmt.Errorf("invalid type %q (must be host or service)", r.Type)
+	}
+	switch r.CheckType {
+	case "", "0", "1":
+	default:
+		return fmt.Errorf("invalid checktype %q (must be 0 or 1)", r.CheckType)
+	}
+	if r.IsHost() {
+		if r.State < 0 || r.State > 2 {
+			return fmt.Errorf("invalid host state %d (must be 0-2)", r.State)
+		}
+		return nil
+	}
+	if strings.TrimSpace(r.ServiceName) == "" {
+		return fmt.Errorf("missing servicename for service check result")
+	}
+	if r.State < 0 || r.State > 3 {
+		return fmt.Errorf("invalid service state %d (must be 0-3)", r.State)
+	}
+	return nil
+}
+
+// validateName rejects host and service names that could break out of the field they are
+// written to: control characters would start new lines in spool files, generated config
+// and the command file, and ';' separates command file fields and starts a comment in
+// Nagios object definitions. This must run before the name is matched against a scope.
+func validateName(field, name string) error {
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("invalid %s: contains control characters", field)
+		}
+		if c == ';' {
+			return fmt.Errorf("invalid %s: contains ';'", field)
+		}
+	}
+	return nil
+}
+
+// Label returns the state label appropriate for the result type
+func (r Result) Label() string {
+	if r.IsHost() {
+		return HostStateLabel(r.State)
+	}
+	return StateLabel(r.State)
+}
+
 // StateLabel returns the string representation of a check state
 func StateLabel(state int) string {
 	switch state {
@@ -47,6 +153,20 @@ func StateLabel(state int) string {
 	}
 }
 
+// HostStateLabel returns the string representation of a host check state
+func HostStateLabel(state int) string {
+	switch state {
+	case 0:
+		return "UP"
+	case 1:
+		return "DOWN"
+	case 2:
+		return "UNREACHABLE"
+	default:
+		return fmt.Sprintf("STATE_%d", state)
+	}
+}
+
 // LogSummary logs a summary of the check results
 func (r Results) LogSummary() {
 	if len(r.CheckResult) == 0 {
@@ -85,7 +205,7 @@ func (r Results) LogSummary() {
 				}
 				nonOkServices = append(nonOkServices, map[string]string{
 					"service": result.ServiceName,
-					"state":   StateLabel(result.State),
+					"state":   result.Label(),
 					"output":  output,
 				})
 			}
@@ -102,120 +222,37 @@ func (r Results) LogSummary() {
 	logger.Info(msg)
 }
 
-// Processor handles processing and saving check results
+// Processor hands validated check results to the configured sinks
 type Processor struct {
-	OutputDir string
-	GroupName string
-	Storage   *storage.Manager
+	Sink Sink
 }
 
-// Process processes a single check result
-func (p *Processor) Process(result Result) error {
-	// Check disk space
-	if err := p.Storage.CheckSpace(); err != nil {
-		return fmt.Errorf("storage check failed: %v", err)
-	}
-
-	// Check and wait if too many files
-	for {
-		tooMany, err := p.Storage.CheckFiles()
-		if err != nil {
-			return fmt.Errorf("file count check failed: %v", err)
-		}
-		if !tooMany {
-			break
-		}
-		logger.Logf(logger.LevelDebug, "waiting for files to be processed...")
-		time.Sleep(time.Second * 10)
-	}
-
-	filename, err := p.generateFilename()
-	if err != nil {
-		return fmt.Errorf("failed to generate filename: %v", err)
-	}
-
-	filePath := filepath.Join(p.OutputDir, filename)
-	checkResultData := p.convertToNagiosFormat(result)
-
-	// Write the check result file
-	if err := os.WriteFile(filePath, []byte(checkResultData), 0770); err != nil {
-		return fmt.Errorf("failed to write check result file %s: %v", filePath, err)
-	}
-
-	// Set the group on the check result file
-	if err := p.setFileGroup(filePath); err != nil {
-		os.Remove(filePath)
-		return fmt.Errorf("failed to set group on file %s: %v", filePath, err)
+// NewProcessor creates a processor delivering results to all given sinks in order
+func NewProcessor(sinks ...Sink) *Processor {
+	if len(sinks) == 1 {
+		return &Processor{Sink: sinks[0]}
 	}
+	return &Processor{Sink: MultiSink(sinks)}
+}
 
-	// Create the .ok file
-	okFileName := filePath + ".ok"
-	if err := os.WriteFile(okFileName, []byte{}, 0770); err != nil {
-		os.Remove(filePath)
-		return fmt.Errorf("failed to create .ok file %s: %v", okFileName, err)
+// Process delivers a batch of check results to every sink, attempting all of them even if
+// one fails. When only some sinks fail the error wraps ErrPartialDelivery.
+func (p *Processor) Process(ctx context.Context, results []Result) error {
+	if len(results) == 0 {
+		return nil
 	}
-
-	// Set the group on the .ok file
-	if err := p.setFileGroup(okFileName); err != nil {
-		os.Remove(filePath)
-		os.Remove(okFileName)
-		return fmt.Errorf("failed to set group on .ok file %s: %v", okFileName, err)
+	d := &Delivery{Results: results}
+	err := p.Deliver(ctx, d)
+	if err != nil && d.delivered > 0 {
+		return fmt.Errorf("%w: %w", ErrPartialDelivery, err)
 	}
-
-	logger.Trace(logger.Message{
-		Event: "check_saved",
-		Data: map[string]string{
-			"file": filename,
-			"ok":   okFileName,
-		},
-	})
-
-	return nil
-}
-
-func (p *Processor) generateFilename() (string, error) {
-	rand.Seed(time.Now().UnixNano())
-	num := rand.Intn(1000000)
-	return fmt.Sprintf("c%06d", num), nil
+	return err
 }
 
-func (p *Processor) setFileGroup(fileName string) error {
-	group, err := user.LookupGroup(p.GroupName)
-	if err != nil {
-		return fmt.Errorf("failed to look up group: %v", err)
+// Close closes the sinks
+func (p *Processor) Close() error {
+	if p.Sink == nil {
+		return nil
 	}
-	gid, err := strconv.Atoi(group.Gid)
-	if err != nil {
-		return fmt.Errorf("invalid GID: %v", err)
-	}
-	if err := os.Chown(fileName, -1, gid); err != nil {
-		return fmt.Errorf("failed to change file group: %v", err)
-	}
-	return nil
+	return p.Sink.Close()
 }
-
-func (p *Processor) convertToNagiosFormat(result Result) string {
-	serviceLine := ""
-	if result.ServiceName != "" {
-		serviceLine = fmt.Sprintf("service_description=%s\n", result.ServiceName)
-	}
-
-	return fmt.Sprintf(
-		"### NRDP Check ###\n"+
-			"start_time=%d.0\n"+
-			"# Time: %s\n"+
-			"host_name=%s\n"+
-			"%s"+
-			"check_type=1\n"+
-			"early_timeout=1\n"+
-			"exited_ok=1\n"+
-			"return_code=%d\n"+
-			"output=%s\\n\n",
-		result.Time,
-		time.Unix(result.Time, 0).Format(time.RFC1123Z),
-		result.HostName,
-		serviceLine,
-		result.State,
-		strings.ReplaceAll(result.Output, "\n", "\\n"),
-	)
-} 
\ No newline at end of file
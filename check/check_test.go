@@ -0,0 +1,76 @@
+package check
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestResultValidateNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  Result
+		wantErr bool
+	}{
+		{"host", Result{HostName: "web01"}, false},
+		{"service", Result{HostName: "web01", ServiceName: "HTTP check"}, false},
+		{"unicode", Result{HostName: "wéb01", ServiceName: "Disk /"}, false},
+		{"hostname newline", Result{HostName: "team-a-x\n\nhost_name=team-b-db"}, true},
+		{"hostname carriage return", Result{HostName: "web01\r"}, true},
+		{"hostname tab", Result{HostName: "web\t01"}, true},
+		{"hostname nul", Result{HostName: "web01\x00"}, true},
+		{"hostname C1 control", Result{HostName: "web01\u0085"}, true},
+		{"hostname semicolon", Result{HostName: "web01;other"}, true},
+		{"servicename newline", Result{HostName: "web01", ServiceName: "HTTP\nhost_name=team-b-db"}, true},
+		{"servicename delete", Result{HostName: "web01", ServiceName: "HTTP\x7f"}, true},
+		{"servicename semicolon", Result{HostName: "web01", ServiceName: "HTTP;2;pwned"}, true},
+		{"host result servicename newline", Result{Type: TypeHost, HostName: "web01", ServiceName: "x\ny"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.result.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEscapeOutputTruncation(t *testing.T) {
+	tests := []struct {
+		output string
+		max    int
+		want   string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"truncated output", 9, "truncated"},
+		{"line\r\nnext", 7, "line\\nn"},
+		{"line\nnext", 5, "line"}, // The escape does not fit whole
+		{"line\nnext", 6, "line\\n"},
+		{"caf\u00e9s", 4, "caf"}, // é is two bytes
+		{"caf\u00e9s", 5, "caf\u00e9"},
+		{"\u20ac\u20ac", 5, "\u20ac"}, // € is three bytes
+		{"anything", 0, ""},
+		{"anything", -3, ""},
+	}
+	for _, tt := range tests {
+		got := escapeOutput(tt.output, tt.max)
+		if got != tt.want {
+			t.Errorf("escapeOutput(%q, %d) = %q, want %q", tt.output, tt.max, got, tt.want)
+		}
+		if len(got) > tt.max && tt.max >= 0 {
+			t.Errorf("escapeOutput(%q, %d) is %d bytes long", tt.output, tt.max, len(got))
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("escapeOutput(%q, %d) = %q is not valid UTF-8", tt.output, tt.max, got)
+		}
+	}
+}
+
+func TestResultCommandEscapesOutput(t *testing.T) {
+	r := Result{HostName: "web01", ServiceName: "HTTP", State: 2, Output: "down\r\nPROCESS_HOST_CHECK_RESULT;x;0;ok"}
+	want := "PROCESS_SERVICE_CHECK_RESULT;web01;HTTP;2;down\\nPROCESS_HOST_CHECK_RESULT;x;0;ok"
+	if got := r.Command(); got != want {
+		t.Errorf("Command() = %q, want %q", got, want)
+	}
+}
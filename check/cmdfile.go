@@ -0,0 +1,108 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"nrdp_micro/extcmd"
+	"nrdp_micro/logger"
+)
+
+// CommandFileSink submits check results as external commands through the Nagios command file
+type CommandFileSink struct {
+	Commands *extcmd.Writer
+}
+
+// NewCommandFileSink creates a sink writing to the given command file writer
+func NewCommandFileSink(commands *extcmd.Writer) *CommandFileSink {
+	return &CommandFileSink{Commands: commands}
+}
+
+// Write submits the check results, grouping those with the same check time into one write
+func (c *CommandFileSink) Write(ctx context.Context, results []Result) error {
+	now := time.Now()
+	for start := 0; start < len(results); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ts := results[start].checkTime(now)
+		end := start + 1
+		for end < len(results) && results[end].checkTime(now).Unix() == ts.Unix() {
+			end++
+		}
+
+		commands := make([]string, 0, end-start)
+		for _, result := range results[start:end] {
+			commands = append(commands, result.Command())
+		}
+		if err := c.Commands.SubmitAll(ts, commands); err != nil {
+			if errors.Is(err, extcmd.ErrInvalidCommand) {
+				return fmt.Errorf("%w: %w", ErrPermanent, err)
+			}
+			return fmt.Errorf("failed to submit check result commands: %v", err)
+		}
+		start = end
+	}
+
+	logger.Trace(logger.Message{
+		Event: "checks_submitted",
+		Data: map[string]interface{}{
+			"count":        len(results),
+			"command_file": c.Commands.Path(),
+		},
+	})
+
+	return nil
+}
+
+// Close closes the command file
+func (c *CommandFileSink) Close() error {
+	return c.Commands.Close()
+}
+
+// Command returns the Nagios external command that submits the result.
+// Line breaks in the output are escaped, and the output is truncated so the
+// command fits in a single atomic write to the command pipe.
+func (r Result) Command() string {
+	var prefix string
+	if r.IsHost() {
+		prefix = fmt.Sprintf("PROCESS_HOST_CHECK_RESULT;%s;%d;", r.HostName, r.State)
+	} else {
+		prefix = fmt.Sprintf("PROCESS_SERVICE_CHECK_RESULT;%s;%s;%d;", r.HostName, r.ServiceName, r.State)
+	}
+	return prefix + escapeOutput(r.Output, extcmd.MaxCommandLength-len(prefix))
+}
+
+// escapeOutput escapes the line breaks of plugin output for a command line of at most max
+// bytes. It truncates between characters, so neither a UTF-8 sequence nor an escape is cut.
+func escapeOutput(output string, max int) string {
+	var b strings.Builder
+	for i := 0; i < len(output); {
+		_, size := utf8.DecodeRuneInString(output[i:])
+		piece := output[i : i+size]
+		i += size
+		switch piece {
+		case "\r":
+			continue
+		case "\n":
+			piece = "\\n"
+		}
+		if b.Len()+len(piece) > max {
+			break
+		}
+		b.WriteString(piece)
+	}
+	return b.String()
+}
+
+// checkTime returns the time the check was executed, or now when the client did not send one
+func (r Result) checkTime(now time.Time) time.Time {
+	if r.Time > 0 {
+		return time.Unix(r.Time, 0)
+	}
+	return now
+}
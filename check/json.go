@@ -0,0 +1,157 @@
+package check
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonResults is the NRDP JSONDATA document
+type jsonResults struct {
+	CheckResults []jsonResult `json:"checkresults"`
+}
+
+// jsonResult is a single entry of the JSONDATA checkresults array
+type jsonResult struct {
+	CheckResult struct {
+		Type      string     `json:"type"`
+		CheckType flexString `json:"checktype"`
+	} `json:"checkresult"`
+	HostName    string    `json:"hostname"`
+	ServiceName string    `json:"servicename"`
+	State       flexInt   `json:"state"`
+	Output      string    `json:"output"`
+	Time        flexInt64 `json:"time"`
+}
+
+// flexString accepts both JSON strings and numbers and keeps their text
+type flexString string
+
+func (f *flexString) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*f = ""
+		return nil
+	}
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*f = flexString(s)
+		return nil
+	}
+	*f = flexString(data)
+	return nil
+}
+
+// flexInt accepts both JSON numbers and numeric strings, as NRDP clients send either
+type flexInt int
+
+func (f *flexInt) UnmarshalJSON(data []byte) error {
+	v, err := parseFlexNumber(data)
+	if err != nil {
+		return err
+	}
+	*f = flexInt(v)
+	return nil
+}
+
+// flexInt64 is the 64-bit variant of flexInt used for timestamps
+type flexInt64 int64
+
+func (f *flexInt64) UnmarshalJSON(data []byte) error {
+	v, err := parseFlexNumber(data)
+	if err != nil {
+		return err
+	}
+	*f = flexInt64(v)
+	return nil
+}
+
+func parseFlexNumber(data []byte) (int64, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return 0, nil
+	}
+	s := string(data)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return 0, err
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return 0, nil
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Accept timestamps with a fractional part such as "1700000000.5"
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+		v = int64(f)
+	}
+	return v, nil
+}
+
+// ParseXML decodes an NRDP XMLDATA document
+func ParseXML(data []byte) (Results, error) {
+	var results Results
+	if err := xml.Unmarshal(data, &results); err != nil {
+		return Results{}, err
+	}
+	return results, nil
+}
+
+// ParseJSON decodes an NRDP JSONDATA document into the same Results used for XMLDATA
+func ParseJSON(data []byte) (Results, error) {
+	var doc jsonResults
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Results{}, err
+	}
+
+	results := Results{CheckResult: make([]Result, 0, len(doc.CheckResults))}
+	for _, jr := range doc.CheckResults {
+		results.CheckResult = append(results.CheckResult, Result{
+			Type:        strings.ToLower(strings.TrimSpace(jr.CheckResult.Type)),
+			CheckType:   strings.TrimSpace(string(jr.CheckResult.CheckType)),
+			HostName:    jr.HostName,
+			ServiceName: jr.ServiceName,
+			State:       int(jr.State),
+			Output:      jr.Output,
+			Time:        int64(jr.Time),
+		})
+	}
+	return results, nil
+}
+
+// EncodeXML builds the XMLDATA document for the given results
+func EncodeXML(results []Result) ([]byte, error) {
+	body, err := xml.Marshal(Results{CheckResult: results})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(xml.Header + string(body)), nil
+}
+
+// EncodeJSON builds the JSONDATA document for the given results
+func EncodeJSON(results []Result) ([]byte, error) {
+	doc := jsonResults{CheckResults: make([]jsonResult, 0, len(results))}
+	for _, r := range results {
+		var jr jsonResult
+		jr.CheckResult.Type = r.Type
+		jr.CheckResult.CheckType = flexString(r.CheckType)
+		jr.HostName = r.HostName
+		jr.ServiceName = r.ServiceName
+		jr.State = flexInt(r.State)
+		jr.Output = r.Output
+		jr.Time = flexInt64(r.Time)
+		doc.CheckResults = append(doc.CheckResults, jr)
+	}
+	return json.Marshal(doc)
+}
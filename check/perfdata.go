@@ -0,0 +1,215 @@
+package check
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"nrdp_micro/logger"
+)
+
+// PerfDatum is a single performance data metric as defined by the Nagios plugin guidelines:
+// 'label'=value[UOM];[warn];[crit];[min];[max]
+type PerfDatum struct {
+	Label string
+	Value float64
+	UOM   string
+	Warn  string // Threshold range, kept verbatim (e.g. "10", "~:20", "@5:10"), empty when invalid
+	Crit  string
+	Min   *float64
+	Max   *float64
+}
+
+// Output is plugin output split into its text and performance data parts
+type Output struct {
+	Short    string // First line of text
+	Long     string // Remaining lines of text
+	PerfData []PerfDatum
+}
+
+// ParsePluginOutput splits raw plugin output following the plugin guidelines:
+//
+//	TEXT OUTPUT | OPTIONAL PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE N | PERFDATA LINE 2
+//	PERFDATA LINE 3
+//
+// Performance data items that cannot be parsed are skipped.
+func ParsePluginOutput(raw string) Output {
+	var out Output
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	var perf []string
+	first := lines[0]
+	if i := strings.Index(first, "|"); i >= 0 {
+		out.Short = strings.TrimSpace(first[:i])
+		perf = append(perf, first[i+1:])
+	} else {
+		out.Short = strings.TrimSpace(first)
+	}
+
+	var long []string
+	inPerf := false
+	for _, line := range lines[1:] {
+		if inPerf {
+			perf = append(perf, line)
+			continue
+		}
+		if i := strings.Index(line, "|"); i >= 0 {
+			long = append(long, line[:i])
+			perf = append(perf, line[i+1:])
+			inPerf = true
+			continue
+		}
+		long = append(long, line)
+	}
+	out.Long = strings.TrimRight(strings.Join(long, "\n"), "\n ")
+
+	for _, chunk := range perf {
+		out.PerfData = append(out.PerfData, parsePerfData(chunk)...)
+	}
+	return out
+}
+
+// PluginOutput returns the parsed plugin output, parsing it on first use
+func (r *Result) PluginOutput() *Output {
+	if r.Parsed == nil {
+		parsed := ParsePluginOutput(r.Output)
+		r.Parsed = &parsed
+	}
+	return r.Parsed
+}
+
+// parsePerfData parses a space separated list of performance data items
+func parsePerfData(s string) []PerfDatum {
+	var data []PerfDatum
+	for _, item := range splitPerfItems(s) {
+		datum, ok := parsePerfDatum(item)
+		if !ok {
+			logger.Logf(logger.LevelTrace, "skipping unparsable perfdata item %q", item)
+			continue
+		}
+		data = append(data, datum)
+	}
+	return data
+}
+
+// splitPerfItems splits perfdata on whitespace, keeping quoted labels (which may
+// contain spaces and doubled single quotes) together with their values.
+func splitPerfItems(s string) []string {
+	var items []string
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'':
+			if quoted && i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteString("''")
+				i++
+				continue
+			}
+			quoted = !quoted
+			b.WriteByte(c)
+		case !quoted && (c == ' ' || c == '\t' || c == '\n'):
+			if b.Len() > 0 {
+				items = append(items, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if b.Len() > 0 {
+		items = append(items, b.String())
+	}
+	return items
+}
+
+// parsePerfDatum parses a single 'label'=value[UOM];[warn];[crit];[min];[max] item
+func parsePerfDatum(item string) (PerfDatum, bool) {
+	eq := strings.LastIndex(item, "=")
+	if eq <= 0 {
+		return PerfDatum{}, false
+	}
+	label := item[:eq]
+	if len(label) >= 2 && strings.HasPrefix(label, "'") && strings.HasSuffix(label, "'") {
+		label = strings.ReplaceAll(label[1:len(label)-1], "''", "'")
+	}
+	if label == "" {
+		return PerfDatum{}, false
+	}
+
+	fields := strings.Split(item[eq+1:], ";")
+	value, uom, ok := splitValueUOM(fields[0])
+	if !ok {
+		return PerfDatum{}, false
+	}
+
+	datum := PerfDatum{Label: label, Value: value, UOM: uom}
+	if len(fields) > 1 {
+		datum.Warn = parseThreshold(fields[1])
+	}
+	if len(fields) > 2 {
+		datum.Crit = parseThreshold(fields[2])
+	}
+	if len(fields) > 3 {
+		datum.Min = parseOptionalFloat(fields[3])
+	}
+	if len(fields) > 4 {
+		datum.Max = parseOptionalFloat(fields[4])
+	}
+	return datum, true
+}
+
+// splitValueUOM separates a numeric value from its unit of measurement.
+// Values of "U" (undetermined) and values out of the float64 range are rejected.
+func splitValueUOM(s string) (float64, string, bool) {
+	end := 0
+	for end < len(s) && strings.IndexByte("0123456789.,+-eE", s[end]) >= 0 {
+		// An 'e' only belongs to the number when it is an exponent, not the start of a unit
+		if (s[end] == 'e' || s[end] == 'E') && (end+1 >= len(s) || strings.IndexByte("0123456789+-", s[end+1]) < 0) {
+			break
+		}
+		end++
+	}
+	if end == 0 {
+		return 0, "", false
+	}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(s[:end], ",", "."), 64)
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, "", false
+	}
+	return value, s[end:], true
+}
+
+// parseThreshold returns a warn or crit range ([@][start:]end, with ~ for negative
+// infinity) verbatim, or an empty string when it holds anything but finite numbers
+func parseThreshold(s string) string {
+	bounds := strings.Split(strings.TrimPrefix(s, "@"), ":")
+	if len(bounds) > 2 {
+		return ""
+	}
+	for i, bound := range bounds {
+		if bound == "" || (i == 0 && len(bounds) == 2 && bound == "~") {
+			continue
+		}
+		if parseOptionalFloat(bound) == nil {
+			return ""
+		}
+	}
+	return s
+}
+
+// parseOptionalFloat parses a min or max field, returning nil when it is empty, invalid
+// or not finite ("inf", "nan" and out of range values)
+func parseOptionalFloat(s string) *float64 {
+	if s == "" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", "."), 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
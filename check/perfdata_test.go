@@ -0,0 +1,128 @@
+package check
+
+import (
+	"reflect"
+	"testing"
+)
+
+func float(v float64) *float64 { return &v }
+
+func TestParsePerfDatum(t *testing.T) {
+	tests := []struct {
+		item string
+		want PerfDatum
+		ok   bool
+	}{
+		{"time=0.5", PerfDatum{Label: "time", Value: 0.5}, true},
+		{"time=0.5s", PerfDatum{Label: "time", Value: 0.5, UOM: "s"}, true},
+		{"used=80%;90;95", PerfDatum{Label: "used", Value: 80, UOM: "%", Warn: "90", Crit: "95"}, true},
+		{"used=80%;~:90;@95:100;0;100", PerfDatum{Label: "used", Value: 80, UOM: "%", Warn: "~:90", Crit: "@95:100", Min: float(0), Max: float(100)}, true},
+		{"size=1024B;;;0;", PerfDatum{Label: "size", Value: 1024, UOM: "B", Min: float(0)}, true},
+		{"load=-1.5;;;x;2", PerfDatum{Label: "load", Value: -1.5, Max: float(2)}, true},
+		{"'Disk /'=42GB", PerfDatum{Label: "Disk /", Value: 42, UOM: "GB"}, true},
+		{"'it''s'=1", PerfDatum{Label: "it's", Value: 1}, true},
+		{"'a=b'=1", PerfDatum{Label: "a=b", Value: 1}, true},
+		{"rate=1,5;;;0,5;2,5", PerfDatum{Label: "rate", Value: 1.5, Min: float(0.5), Max: float(2.5)}, true},
+		{"big=1e3", PerfDatum{Label: "big", Value: 1000}, true},
+		{"small=2.5E-3s", PerfDatum{Label: "small", Value: 0.0025, UOM: "s"}, true},
+		{"count=3events", PerfDatum{Label: "count", Value: 3, UOM: "events"}, true},
+		{"ratio=1;;;inf;NaN", PerfDatum{Label: "ratio", Value: 1}, true},
+		{"ratio=1;;;-Infinity;1e999", PerfDatum{Label: "ratio", Value: 1}, true},
+		{"ratio=1;inf;~:NaN", PerfDatum{Label: "ratio", Value: 1}, true},
+		{"ratio=1;1:2:3;@x", PerfDatum{Label: "ratio", Value: 1}, true},
+		{"ratio=1;10:;@~:1,5", PerfDatum{Label: "ratio", Value: 1, Warn: "10:", Crit: "@~:1,5"}, true},
+		{"huge=1e999", PerfDatum{}, false},
+		{"huge=-1e999B", PerfDatum{}, false},
+		{"value=inf", PerfDatum{}, false},
+		{"value=NaN", PerfDatum{}, false},
+		{"value=U", PerfDatum{}, false},
+		{"value=", PerfDatum{}, false},
+		{"=1", PerfDatum{}, false},
+		{"''=1", PerfDatum{}, false},
+		{"novalue", PerfDatum{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.item, func(t *testing.T) {
+			got, ok := parsePerfDatum(tt.item)
+			if ok != tt.ok {
+				t.Fatalf("parsePerfDatum(%q) ok = %v, want %v", tt.item, ok, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePerfDatum(%q) = %+v, want %+v", tt.item, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePluginOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want Output
+	}{
+		{
+			name: "text only",
+			raw:  "OK - all good",
+			want: Output{Short: "OK - all good"},
+		},
+		{
+			name: "short with perfdata",
+			raw:  "OK - load fine | load1=0.5;1;2 load5=0.25",
+			want: Output{
+				Short: "OK - load fine",
+				PerfData: []PerfDatum{
+					{Label: "load1", Value: 0.5, Warn: "1", Crit: "2"},
+					{Label: "load5", Value: 0.25},
+				},
+			},
+		},
+		{
+			name: "quoted labels with spaces",
+			raw:  "DISK OK | '/ free'=10GB;;;0;20 '/var free'=5GB",
+			want: Output{
+				Short: "DISK OK",
+				PerfData: []PerfDatum{
+					{Label: "/ free", Value: 10, UOM: "GB", Min: float(0), Max: float(20)},
+					{Label: "/var free", Value: 5, UOM: "GB"},
+				},
+			},
+		},
+		{
+			name: "long output with perfdata on later lines",
+			raw:  "DISK OK - free space: / 3326 MB | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);\n/boot 68 MB (69%); | /boot=68MB;88;93;0;98\n/home=69357MB;253404;253409;0;253414\r\n/var/log=819MB;970;975;0;980",
+			want: Output{
+				Short: "DISK OK - free space: / 3326 MB",
+				Long:  "/ 15272 MB (77%);\n/boot 68 MB (69%);",
+				PerfData: []PerfDatum{
+					{Label: "/", Value: 2643, UOM: "MB", Warn: "5948", Crit: "5958", Min: float(0), Max: float(5968)},
+					{Label: "/boot", Value: 68, UOM: "MB", Warn: "88", Crit: "93", Min: float(0), Max: float(98)},
+					{Label: "/home", Value: 69357, UOM: "MB", Warn: "253404", Crit: "253409", Min: float(0), Max: float(253414)},
+					{Label: "/var/log", Value: 819, UOM: "MB", Warn: "970", Crit: "975", Min: float(0), Max: float(980)},
+				},
+			},
+		},
+		{
+			name: "long output without perfdata",
+			raw:  "WARNING - 2 issues\nfirst\nsecond\n",
+			want: Output{Short: "WARNING - 2 issues", Long: "first\nsecond"},
+		},
+		{
+			name: "unparsable items skipped",
+			raw:  "OK | good=1 bad=U =2 also_good=2c",
+			want: Output{
+				Short: "OK",
+				PerfData: []PerfDatum{
+					{Label: "good", Value: 1},
+					{Label: "also_good", Value: 2, UOM: "c"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParsePluginOutput(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePluginOutput(%q) =\n%+v\nwant\n%+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
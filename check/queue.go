@@ -0,0 +1,133 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"nrdp_micro/queue"
+)
+
+// queuedResult is the stable on-disk encoding of a Result in the ingest queue
+type queuedResult struct {
+	Type        string `json:"type,omitempty"`
+	CheckType   string `json:"checktype,omitempty"`
+	HostName    string `json:"hostname"`
+	ServiceName string `json:"servicename,omitempty"`
+	State       int    `json:"state"`
+	Output      string `json:"output"`
+	Time        int64  `json:"time,omitempty"`
+}
+
+// QueueSink appends check results to the durable ingest queue.
+// A successful Write means the results are on disk; they are delivered to the
+// real sinks asynchronously by a queue.Drainer using DecodeQueued.
+type QueueSink struct {
+	Queue *queue.Queue
+}
+
+// NewQueueSink creates a sink appending to q
+func NewQueueSink(q *queue.Queue) *QueueSink {
+	return &QueueSink{Queue: q}
+}
+
+// Write appends the results as a single queue record
+func (s *QueueSink) Write(ctx context.Context, results []Result) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := EncodeQueued(results)
+	if err != nil {
+		return err
+	}
+	if err := s.Queue.Append(payload); err != nil {
+		return fmt.Errorf("failed to queue check results: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink; the queue itself is closed by its owner after the drainer stops
+func (s *QueueSink) Close() error {
+	return nil
+}
+
+// QueueHandler returns the queue.HandlerFunc that delivers queued records to the processor's
+// sinks. Records that cannot be decoded, or that every failing sink rejects permanently, are
+// discarded. While a record is retried, the sinks that already took it are skipped.
+func QueueHandler(p *Processor) queue.HandlerFunc {
+	var (
+		record   []byte    // Payload of the record in progress
+		delivery *Delivery // Its progress through the sinks
+	)
+	return func(ctx context.Context, payload []byte) error {
+		if delivery == nil || !bytes.Equal(payload, record) {
+			results, err := DecodeQueued(payload)
+			if err != nil {
+				return fmt.Errorf("%w: %v", queue.ErrDiscard, err)
+			}
+			record = append(record[:0], payload...)
+			delivery = &Delivery{Results: results}
+		}
+
+		err := p.Deliver(ctx, delivery)
+		if err != nil && !errors.Is(err, ErrPermanent) {
+			return err
+		}
+		delivery = nil
+		if err != nil {
+			return fmt.Errorf("%w: %v", queue.ErrDiscard, err)
+		}
+		return nil
+	}
+}
+
+// EncodeQueued serializes results for the ingest queue.
+// Results without a check time are stamped with the current time, so a result
+// delivered late from the queue still carries the time it was received.
+func EncodeQueued(results []Result) ([]byte, error) {
+	now := time.Now().Unix()
+	records := make([]queuedResult, 0, len(results))
+	for _, r := range results {
+		if r.Time <= 0 {
+			r.Time = now
+		}
+		records = append(records, queuedResult{
+			Type:        r.Type,
+			CheckType:   r.CheckType,
+			HostName:    r.HostName,
+			ServiceName: r.ServiceName,
+			State:       r.State,
+			Output:      r.Output,
+			Time:        r.Time,
+		})
+	}
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode check results: %v", err)
+	}
+	return payload, nil
+}
+
+// DecodeQueued restores results written by EncodeQueued
+func DecodeQueued(payload []byte) ([]Result, error) {
+	var records []queuedResult
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode queued check results: %v", err)
+	}
+	results := make([]Result, 0, len(records))
+	for _, r := range records {
+		results = append(results, Result{
+			Type:        r.Type,
+			CheckType:   r.CheckType,
+			HostName:    r.HostName,
+			ServiceName: r.ServiceName,
+			State:       r.State,
+			Output:      r.Output,
+			Time:        r.Time,
+		})
+	}
+	return results, nil
+}
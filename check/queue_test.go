@@ -0,0 +1,108 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"nrdp_micro/queue"
+)
+
+// recordingSink counts writes and fails with the queued errors first
+type recordingSink struct {
+	writes int
+	errs   []error
+}
+
+func (s *recordingSink) Write(ctx context.Context, results []Result) error {
+	s.writes++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func queuedPayload(t *testing.T) []byte {
+	t.Helper()
+	payload, err := EncodeQueued([]Result{{HostName: "web01", ServiceName: "HTTP", Output: "OK"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestQueueHandlerSkipsDeliveredSinks(t *testing.T) {
+	first := &recordingSink{}
+	second := &recordingSink{errs: []error{errors.New("unavailable"), errors.New("unavailable")}}
+	handle := QueueHandler(NewProcessor(first, second))
+	payload := queuedPayload(t)
+
+	for i := 0; i < 2; i++ {
+		if err := handle(context.Background(), payload); err == nil {
+			t.Fatalf("attempt %d: expected an error while the second sink fails", i)
+		}
+	}
+	if err := handle(context.Background(), payload); err != nil {
+		t.Fatalf("expected delivery to succeed, got %v", err)
+	}
+	if first.writes != 1 {
+		t.Errorf("first sink written %d times, want 1", first.writes)
+	}
+	if second.writes != 3 {
+		t.Errorf("second sink written %d times, want 3", second.writes)
+	}
+
+	// The next record starts a new delivery to every sink
+	if err := handle(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if first.writes != 2 {
+		t.Errorf("first sink written %d times after the next record, want 2", first.writes)
+	}
+}
+
+func TestQueueHandlerDiscardsPermanentFailures(t *testing.T) {
+	first := &recordingSink{errs: []error{ErrPermanent}}
+	second := &recordingSink{}
+	handle := QueueHandler(NewProcessor(first, second))
+
+	err := handle(context.Background(), queuedPayload(t))
+	if !errors.Is(err, queue.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+	if second.writes != 1 {
+		t.Errorf("second sink written %d times, want 1", second.writes)
+	}
+}
+
+func TestQueueHandlerRetriesWhenAnySinkIsTemporary(t *testing.T) {
+	first := &recordingSink{errs: []error{ErrPermanent}}
+	second := &recordingSink{errs: []error{errors.New("unavailable")}}
+	handle := QueueHandler(NewProcessor(first, second))
+	payload := queuedPayload(t)
+
+	if err := handle(context.Background(), payload); err == nil || errors.Is(err, queue.ErrDiscard) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+	if err := handle(context.Background(), payload); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if first.writes != 1 {
+		t.Errorf("permanently failed sink written %d times, want 1", first.writes)
+	}
+}
+
+func TestQueueHandlerDiscardsUndecodableRecords(t *testing.T) {
+	sink := &recordingSink{}
+	err := QueueHandler(NewProcessor(sink))(context.Background(), []byte("not json"))
+	if !errors.Is(err, queue.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+	if sink.writes != 0 {
+		t.Errorf("sink written %d times, want 0", sink.writes)
+	}
+}
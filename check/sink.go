@@ -0,0 +1,111 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"nrdp_micro/logger"
+)
+
+// ErrPermanent is wrapped by sinks around errors that retrying the same results cannot fix,
+// such as results the destination will never accept
+var ErrPermanent = errors.New("permanent delivery failure")
+
+// ErrPartialDelivery is wrapped around the error of Process when some sinks took the results
+// and others failed. Writing the results again would duplicate them in the sinks that
+// succeeded, so callers should treat them as accepted.
+var ErrPartialDelivery = errors.New("results delivered to some sinks only")
+
+// Sink delivers check results to a destination such as the Nagios spool
+type Sink interface {
+	// Write delivers the results, returning an error if any of them could not be delivered
+	Write(ctx context.Context, results []Result) error
+	// Close releases resources held by the sink
+	Close() error
+}
+
+// MultiSink chains several sinks, delivering every result to each of them in order
+type MultiSink []Sink
+
+// Write writes the results to every sink. All sinks are attempted even if one fails,
+// so a broken secondary destination does not starve the others.
+func (m MultiSink) Write(ctx context.Context, results []Result) error {
+	var errs []error
+	for i, sink := range m {
+		if err := sink.Write(ctx, results); err != nil {
+			logger.Logf(logger.LevelDebug, "sink %d (%T) failed: %v", i, sink, err)
+			errs = append(errs, fmt.Errorf("%T: %w", sink, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink
+func (m MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sinkList returns the individual sinks behind s
+func sinkList(s Sink) []Sink {
+	if m, ok := s.(MultiSink); ok {
+		return m
+	}
+	return []Sink{s}
+}
+
+// Delivery is a batch of check results on its way to a processor's sinks. It records which
+// sinks have taken the batch, so a retry after a failure only writes to the sinks that
+// failed instead of writing duplicates to the others.
+type Delivery struct {
+	Results   []Result
+	done      []bool
+	delivered int // Sinks that took the batch
+}
+
+// Deliver writes the batch to every sink that has not received it yet. Sinks that fail
+// with ErrPermanent are given up on for this batch. The error returned is nil once every
+// sink is done, wraps ErrPermanent when only permanent failures remain, and otherwise
+// joins the failures worth retrying with the same Delivery.
+func (p *Processor) Deliver(ctx context.Context, d *Delivery) error {
+	if p.Sink == nil {
+		return fmt.Errorf("no sink configured")
+	}
+	sinks := sinkList(p.Sink)
+	if d.done == nil {
+		d.done = make([]bool, len(sinks))
+	}
+	for i := range d.Results {
+		d.Results[i].PluginOutput()
+	}
+
+	var retry, permanent []error
+	for i, sink := range sinks {
+		if d.done[i] {
+			continue
+		}
+		err := sink.Write(ctx, d.Results)
+		switch {
+		case err == nil:
+			d.done[i] = true
+			d.delivered++
+		case errors.Is(err, ErrPermanent):
+			logger.Logf(logger.LevelInfo, "Dropping %d check results for sink %d (%T): %v", len(d.Results), i, sink, err)
+			d.done[i] = true
+			permanent = append(permanent, fmt.Errorf("%T: %w", sink, err))
+		default:
+			logger.Logf(logger.LevelDebug, "sink %d (%T) failed: %v", i, sink, err)
+			retry = append(retry, fmt.Errorf("%T: %w", sink, err))
+		}
+	}
+	if len(retry) > 0 {
+		return errors.Join(retry...)
+	}
+	return errors.Join(permanent...)
+}
@@ -0,0 +1,48 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestProcessPartialDelivery(t *testing.T) {
+	results := []Result{{HostName: "web01", ServiceName: "HTTP", Output: "OK"}}
+	failure := errors.New("unavailable")
+
+	tests := []struct {
+		name        string
+		sinks       []*recordingSink
+		wantErr     bool
+		wantPartial bool
+	}{
+		{"all succeed", []*recordingSink{{}, {}}, false, false},
+		{"second fails", []*recordingSink{{}, {errs: []error{failure}}}, true, true},
+		{"first fails", []*recordingSink{{errs: []error{failure}}, {}}, true, true},
+		{"all fail", []*recordingSink{{errs: []error{failure}}, {errs: []error{failure}}}, true, false},
+		{"only sink fails", []*recordingSink{{errs: []error{failure}}}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sinks := make([]Sink, len(tt.sinks))
+			for i, s := range tt.sinks {
+				sinks[i] = s
+			}
+			err := NewProcessor(sinks...).Process(context.Background(), results)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := errors.Is(err, ErrPartialDelivery); got != tt.wantPartial {
+				t.Errorf("Process() error = %v, partial %v, want %v", err, got, tt.wantPartial)
+			}
+			if err != nil && !errors.Is(err, failure) {
+				t.Errorf("Process() error = %v, does not wrap the sink failure", err)
+			}
+			for i, s := range tt.sinks {
+				if s.writes != 1 {
+					t.Errorf("sink %d written %d times, want 1", i, s.writes)
+				}
+			}
+		})
+	}
+}
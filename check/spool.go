@@ -0,0 +1,330 @@
+package check
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/logger"
+	"nrdp_micro/storage"
+)
+
+const (
+	// filenameChars are the characters mkstemp substitutes for the XXXXXX template
+	filenameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	// spoolTempPattern names in-progress files; Nagios only reaps names starting with 'c'
+	spoolTempPattern    = ".nrdp-*.tmp"
+	spoolFileMode       = 0770
+	maxFilenameAttempts = 100
+	// staleSpoolFileAge is how old a leftover temporary or placeholder file must be
+	// before RemoveStaleFiles deletes it, so files of a writer still running are kept
+	staleSpoolFileAge = time.Minute
+)
+
+// ErrSpoolFull is returned when the spool directory holds too many unprocessed files
+var ErrSpoolFull = errors.New("spool directory is full")
+
+// SpoolSink writes check results as files into the Nagios check_result_path
+type SpoolSink struct {
+	OutputDir  string
+	GroupName  string
+	Storage    *storage.Manager
+	MaxPerFile int // Maximum results per spool file, 1 or less writes one file per result
+}
+
+// NewSpoolSink creates a sink writing into the given spool directory
+func NewSpoolSink(outputDir, groupName string, storageManager *storage.Manager, maxPerFile int) *SpoolSink {
+	return &SpoolSink{
+		OutputDir:  outputDir,
+		GroupName:  groupName,
+		Storage:    storageManager,
+		MaxPerFile: maxPerFile,
+	}
+}
+
+// Write writes the check results, grouping up to MaxPerFile of them into each spool file.
+// Disk space and the file limit are checked for all of the files before the first one is
+// written, so a full spool refuses the whole batch instead of leaving part of it behind
+// for a retry to duplicate.
+func (p *SpoolSink) Write(ctx context.Context, results []Result) error {
+	perFile := p.MaxPerFile
+	if perFile < 1 {
+		perFile = 1
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	// Check disk space
+	if err := p.Storage.CheckSpace(); err != nil {
+		return fmt.Errorf("storage check failed: %v", err)
+	}
+
+	// Refuse new files while Nagios is behind; the caller reports this to the
+	// client so it can retry later instead of the request blocking here
+	files := (len(results) + perFile - 1) / perFile
+	tooMany, err := p.Storage.CheckRoom(files)
+	if err != nil {
+		return fmt.Errorf("file count check failed: %v", err)
+	}
+	if tooMany {
+		return ErrSpoolFull
+	}
+
+	for start := 0; start < len(results); start += perFile {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + perFile
+		if end > len(results) {
+			end = len(results)
+		}
+		if err := p.writeBatch(results[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Sink; the spool sink holds no resources
+func (p *SpoolSink) Close() error {
+	return nil
+}
+
+// writeBatch writes the check results as a single file in the Nagios check result spool.
+// Nagios reads each blank-line separated block of the file as a separate result.
+func (p *SpoolSink) writeBatch(results []Result) error {
+	blocks := make([]string, 0, len(results))
+	for _, result := range results {
+		blocks = append(blocks, p.convertToNagiosFormat(result))
+	}
+
+	filename, err := p.writeSpoolFile([]byte(strings.Join(blocks, "\n")))
+	if err != nil {
+		return err
+	}
+
+	logger.Trace(logger.Message{
+		Event: "check_saved",
+		Data: map[string]interface{}{
+			"file":    filename,
+			"ok":      filename + ".ok",
+			"results": len(results),
+		},
+	})
+
+	return nil
+}
+
+// writeSpoolFile stores data as a new check result file and marks it ready with a .ok file.
+// The data is written and synced to a hidden temporary file first and then renamed onto a
+// name reserved with O_EXCL, so the reaper never sees a partial file and concurrent writers
+// never overwrite each other's results. It returns the final file name.
+func (p *SpoolSink) writeSpoolFile(data []byte) (string, error) {
+	tmp, err := os.CreateTemp(p.OutputDir, spoolTempPattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary check result file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	cleanupTmp := func() {
+		tmp.Close()
+		os.Remove(tmpPath)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		cleanupTmp()
+		return "", fmt.Errorf("failed to write temporary check result file %s: %v", tmpPath, err)
+	}
+	if err := tmp.Chmod(spoolFileMode); err != nil {
+		cleanupTmp()
+		return "", fmt.Errorf("failed to set mode on %s: %v", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanupTmp()
+		return "", fmt.Errorf("failed to sync temporary check result file %s: %v", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to close temporary check result file %s: %v", tmpPath, err)
+	}
+
+	// Set the group on the check result file
+	if err := p.setFileGroup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to set group on file %s: %v", tmpPath, err)
+	}
+
+	filename, err := p.reserveFilename()
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	filePath := filepath.Join(p.OutputDir, filename)
+
+	// Atomically replace the reserved placeholder with the complete file
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		os.Remove(filePath)
+		return "", fmt.Errorf("failed to rename %s to %s: %v", tmpPath, filePath, err)
+	}
+
+	// Create the .ok file
+	okFileName := filePath + ".ok"
+	okFile, err := os.OpenFile(okFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, spoolFileMode)
+	if err != nil {
+		os.Remove(filePath)
+		return "", fmt.Errorf("failed to create .ok file %s: %v", okFileName, err)
+	}
+	okFile.Close()
+
+	// Set the group on the .ok file
+	if err := p.setFileGroup(okFileName); err != nil {
+		os.Remove(filePath)
+		os.Remove(okFileName)
+		return "", fmt.Errorf("failed to set group on .ok file %s: %v", okFileName, err)
+	}
+
+	return filename, nil
+}
+
+// reserveFilename claims a unique cXXXXXX name in the spool directory, like the
+// mkstemp template Nagios uses for its own check result files. The name is created
+// with O_EXCL so no two writers can claim it, and names whose .ok marker already
+// exists are skipped.
+func (p *SpoolSink) reserveFilename() (string, error) {
+	for attempt := 0; attempt < maxFilenameAttempts; attempt++ {
+		filename, err := generateFilename()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate filename: %v", err)
+		}
+		filePath := filepath.Join(p.OutputDir, filename)
+
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, spoolFileMode)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create check result file %s: %v", filePath, err)
+		}
+		f.Close()
+
+		if _, err := os.Lstat(filePath + ".ok"); err == nil {
+			os.Remove(filePath)
+			continue
+		}
+		return filename, nil
+	}
+	return "", fmt.Errorf("failed to find a free check result file name after %d attempts", maxFilenameAttempts)
+}
+
+// RemoveStaleFiles deletes temporary files and empty cXXXXXX placeholders without a .ok
+// marker left in the spool directory by a writer that died before finishing. Nagios never
+// reaps them, and they count toward storage.max_files. It returns the number removed.
+func RemoveStaleFiles(outputDir string) (int, error) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read spool directory: %v", err)
+	}
+	cutoff := time.Now().Add(-staleSpoolFileAge)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isStaleCandidate(outputDir, entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if !isTempName(entry.Name()) && info.Size() != 0 {
+			continue
+		}
+		path := filepath.Join(outputDir, entry.Name())
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove stale spool file %s: %v", path, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// isStaleCandidate reports whether name is one of our temporary files or a check result
+// name whose .ok marker is missing
+func isStaleCandidate(outputDir, name string) bool {
+	if isTempName(name) {
+		return true
+	}
+	if len(name) != 7 || name[0] != 'c' {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(outputDir, name+".ok"))
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func isTempName(name string) bool {
+	matched, _ := filepath.Match(spoolTempPattern, name)
+	return matched
+}
+
+// generateFilename returns a random name in the Nagios cXXXXXX format
+func generateFilename() (string, error) {
+	var buf [6]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	name := make([]byte, 0, 7)
+	name = append(name, 'c')
+	for _, b := range buf {
+		name = append(name, filenameChars[int(b)%len(filenameChars)])
+	}
+	return string(name), nil
+}
+
+func (p *SpoolSink) setFileGroup(fileName string) error {
+	group, err := user.LookupGroup(p.GroupName)
+	if err != nil {
+		return fmt.Errorf("failed to look up group: %v", err)
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid GID: %v", err)
+	}
+	if err := os.Chown(fileName, -1, gid); err != nil {
+		return fmt.Errorf("failed to change file group: %v", err)
+	}
+	return nil
+}
+
+func (p *SpoolSink) convertToNagiosFormat(result Result) string {
+	serviceLine := ""
+	if !result.IsHost() {
+		serviceLine = fmt.Sprintf("service_description=%s\n", result.ServiceName)
+	}
+
+	return fmt.Sprintf(
+		"### NRDP Check ###\n"+
+			"start_time=%d.0\n"+
+			"# Time: %s\n"+
+			"host_name=%s\n"+
+			"%s"+
+			"check_type=%d\n"+
+			"early_timeout=1\n"+
+			"exited_ok=1\n"+
+			"return_code=%d\n"+
+			"output=%s\\n\n",
+		result.Time,
+		time.Unix(result.Time, 0).Format(time.RFC1123Z),
+		result.HostName,
+		serviceLine,
+		result.NagiosCheckType(),
+		result.State,
+		strings.ReplaceAll(result.Output, "\n", "\\n"),
+	)
+}
@@ -0,0 +1,107 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"nrdp_micro/storage"
+)
+
+func TestRemoveStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * staleSpoolFileAge)
+	files := []struct {
+		name    string
+		data    string
+		old     bool
+		removed bool
+	}{
+		{".nrdp-123.tmp", "partial", true, true},
+		{".nrdp-456.tmp", "in progress", false, false},
+		{"cAAAAAA", "", true, true},        // Placeholder never renamed onto
+		{"cBBBBBB", "", false, false},      // Placeholder of a running writer
+		{"cCCCCCC", "result", true, false}, // Result from another writer, not ours to judge
+		{"cDDDDDD", "result", true, false}, // Complete result
+		{"cDDDDDD.ok", "", true, false},    // Its marker
+		{"cEEEEEE", "", true, false},       // Empty, but marked ready
+		{"cEEEEEE.ok", "", true, false},    // Its marker
+		{"other.tmp", "", true, false},     // Not a name we create
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.data), spoolFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := RemoveStaleFiles(dir)
+	if err != nil {
+		t.Fatalf("RemoveStaleFiles: %v", err)
+	}
+	want := 0
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if f.removed {
+			want++
+			if err == nil {
+				t.Errorf("%s was kept, want removed", f.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s was removed, want kept", f.name)
+		}
+	}
+	if removed != want {
+		t.Errorf("removed %d files, want %d", removed, want)
+	}
+}
+
+func TestSpoolSinkRefusesBatchThatDoesNotFit(t *testing.T) {
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skipf("looking up the current group: %v", err)
+	}
+	dir := t.TempDir()
+	// Room for three files and their .ok markers before the limit of 5 is reached
+	sink := NewSpoolSink(dir, group.Name, storage.NewManager(dir, 5, 0), 1)
+	results := func(n int) []Result {
+		r := make([]Result, n)
+		for i := range r {
+			r[i] = Result{HostName: "web01", ServiceName: "HTTP", Output: "OK"}
+		}
+		return r
+	}
+	countFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	if err := sink.Write(context.Background(), results(4)); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("writing 4 files: %v, want ErrSpoolFull", err)
+	}
+	if n := countFiles(); n != 0 {
+		t.Fatalf("%d files written by a refused batch, want none", n)
+	}
+	if err := sink.Write(context.Background(), results(3)); err != nil {
+		t.Fatalf("writing 3 files: %v", err)
+	}
+	if n := countFiles(); n != 6 {
+		t.Fatalf("%d files after writing 3 results, want 6", n)
+	}
+	if err := sink.Write(context.Background(), results(1)); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("writing to a full spool: %v, want ErrSpoolFull", err)
+	}
+}
@@ -0,0 +1,290 @@
+// Package client submits check results and external commands to an NRDP server,
+// such as nrdp_micro or upstream NRDP.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/logger"
+	"nrdp_micro/nrdp"
+)
+
+// Submission encodings
+const (
+	FormatXML  = "xml"  // Results are sent as XMLDATA
+	FormatJSON = "json" // Results are sent as JSONDATA
+)
+
+// maxResponseSize bounds how much of a response body is read
+const maxResponseSize = 1 << 20
+
+// Options configures a Client
+type Options struct {
+	URL        string        // NRDP endpoint, e.g. https://nagios.example.com/nrdp/
+	Token      string        // Sent in the token form field
+	Format     string        // FormatXML (default) or FormatJSON
+	Timeout    time.Duration // Per attempt, 10s when zero
+	Retries    int           // Additional attempts after a retryable failure
+	Backoff    time.Duration // Wait before the first retry, doubled for each further one; 1s when zero
+	MaxBackoff time.Duration // Upper bound for the wait between attempts, 30s when zero
+	BatchSize  int           // Maximum results per request, 0 sends all results in one request
+	TLSConfig  *tls.Config   // Custom CAs or client certificates, nil uses the system defaults
+	HTTPClient *http.Client  // Overrides Timeout and TLSConfig when set
+}
+
+// Client submits check results and commands to an NRDP server
+type Client struct {
+	opts       Options
+	httpClient *http.Client
+}
+
+// New creates a client from the options
+func New(opts Options) (*Client, error) {
+	if opts.URL == "" {
+		return nil, errors.New("NRDP URL must be specified")
+	}
+	if _, err := url.ParseRequestURI(opts.URL); err != nil {
+		return nil, fmt.Errorf("invalid NRDP URL: %v", err)
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatXML
+	case FormatXML, FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid format %q (must be xml or json)", opts.Format)
+	}
+	if opts.Retries < 0 {
+		return nil, errors.New("retries cannot be negative")
+	}
+	if opts.BatchSize < 0 {
+		return nil, errors.New("batch size cannot be negative")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = opts.TLSConfig
+		httpClient = &http.Client{Timeout: opts.Timeout, Transport: transport}
+	}
+	return &Client{opts: opts, httpClient: httpClient}, nil
+}
+
+// HostResult builds a passive host check result timestamped now
+func HostResult(host string, state int, output string) check.Result {
+	return check.Result{
+		Type:      check.TypeHost,
+		CheckType: strconv.Itoa(check.CheckTypePassive),
+		HostName:  host,
+		State:     state,
+		Output:    output,
+		Time:      time.Now().Unix(),
+	}
+}
+
+// ServiceResult builds a passive service check result timestamped now
+func ServiceResult(host, service string, state int, output string) check.Result {
+	return check.Result{
+		Type:        check.TypeService,
+		CheckType:   strconv.Itoa(check.CheckTypePassive),
+		HostName:    host,
+		ServiceName: service,
+		State:       state,
+		Output:      output,
+		Time:        time.Now().Unix(),
+	}
+}
+
+// Error is returned when the server answers with an error status or response document
+type Error struct {
+	StatusCode int           // HTTP status code
+	Response   nrdp.Response // Decoded response, Message is empty if the body was not an NRDP document
+	RetryAfter time.Duration // Retry-After sent with 429 and 503 responses
+}
+
+func (e *Error) Error() string {
+	if e.Response.Message != "" {
+		return fmt.Sprintf("NRDP server returned %d: %s", e.StatusCode, e.Response.Message)
+	}
+	return fmt.Sprintf("NRDP server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Temporary reports whether the request may succeed when retried: the server was
+// overloaded, rate limited the client or failed internally.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Hello checks connectivity with the server and returns its product and version
+func (c *Client) Hello(ctx context.Context) (nrdp.Response, error) {
+	return c.post(ctx, url.Values{"cmd": {"hello"}})
+}
+
+// SubmitCommand sends a Nagios external command, without the leading [timestamp]
+func (c *Client) SubmitCommand(ctx context.Context, command string) (nrdp.Response, error) {
+	return c.post(ctx, url.Values{"cmd": {"submitcmd"}, "command": {command}})
+}
+
+// SubmitResults sends the check results, split into requests of at most BatchSize.
+// Results without a timestamp are stamped with the current time. When some results are
+// rejected the response says PARTIAL and lists them in Meta.Rejected, indexed into
+// results; this is not an error. An error is returned when a request fails, after the
+// configured retries; the response then covers the requests that succeeded before it.
+func (c *Client) SubmitResults(ctx context.Context, results []check.Result) (nrdp.Response, error) {
+	if len(results) == 0 {
+		return nrdp.Response{}, errors.New("no check results to submit")
+	}
+	now := time.Now().Unix()
+	for i := range results {
+		if results[i].Time == 0 {
+			results[i].Time = now
+		}
+	}
+
+	batchSize := c.opts.BatchSize
+	if batchSize == 0 {
+		batchSize = len(results)
+	}
+
+	total := nrdp.OK("OK")
+	total.Meta = &nrdp.Meta{}
+	for start := 0; start < len(results); start += batchSize {
+		end := start + batchSize
+		if end > len(results) {
+			end = len(results)
+		}
+		resp, err := c.submitBatch(ctx, results[start:end])
+		if err != nil {
+			return total, err
+		}
+		if resp.Meta != nil {
+			total.Meta.Accepted += resp.Meta.Accepted
+			for _, rejection := range resp.Meta.Rejected {
+				rejection.Index += start
+				total.Meta.Rejected = append(total.Meta.Rejected, rejection)
+			}
+		} else {
+			total.Meta.Accepted += end - start // Upstream NRDP sends no meta section
+		}
+	}
+
+	total.Meta.Output = fmt.Sprintf("%d checks processed.", total.Meta.Accepted)
+	if len(total.Meta.Rejected) > 0 {
+		total.Message = "PARTIAL"
+		total.Meta.Output = fmt.Sprintf("%d checks processed, %d rejected.", total.Meta.Accepted, len(total.Meta.Rejected))
+	}
+	return total, nil
+}
+
+// submitBatch sends one request worth of results
+func (c *Client) submitBatch(ctx context.Context, results []check.Result) (nrdp.Response, error) {
+	form := url.Values{"cmd": {"submitcheck"}}
+	if c.opts.Format == FormatJSON {
+		data, err := check.EncodeJSON(results)
+		if err != nil {
+			return nrdp.Response{}, err
+		}
+		form.Set("JSONDATA", string(data))
+	} else {
+		data, err := check.EncodeXML(results)
+		if err != nil {
+			return nrdp.Response{}, err
+		}
+		form.Set("XMLDATA", string(data))
+	}
+	return c.post(ctx, form)
+}
+
+// post sends the form with the token, retrying network errors and temporary server
+// errors with exponential backoff, or after Retry-After when the server sent one
+func (c *Client) post(ctx context.Context, form url.Values) (nrdp.Response, error) {
+	if c.opts.Token != "" {
+		form.Set("token", c.opts.Token)
+	}
+	form.Set("format", c.opts.Format)
+	body := form.Encode()
+
+	backoff := c.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, body)
+		if err == nil {
+			return resp, nil
+		}
+		var serverErr *Error
+		if errors.As(err, &serverErr) && !serverErr.Temporary() {
+			return resp, err
+		}
+		if ctx.Err() != nil || attempt >= c.opts.Retries {
+			return resp, err
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)) // Jitter spreads out agents retrying together
+		if serverErr != nil && serverErr.RetryAfter > 0 {
+			wait = serverErr.RetryAfter
+		}
+		if wait > c.opts.MaxBackoff {
+			wait = c.opts.MaxBackoff
+		}
+		logger.Logf(logger.LevelDebug, "NRDP request failed (%v), retrying in %s", err, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// do performs a single request and decodes the response
+func (c *Client) do(ctx context.Context, body string) (nrdp.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.opts.URL, strings.NewReader(body))
+	if err != nil {
+		return nrdp.Response{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nrdp.Response{}, err
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return nrdp.Response{}, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	resp, decodeErr := nrdp.Decode(data)
+	if httpResp.StatusCode != http.StatusOK || decodeErr == nil && resp.Status != nrdp.StatusOK {
+		serverErr := &Error{StatusCode: httpResp.StatusCode, Response: resp}
+		if seconds, err := strconv.Atoi(httpResp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			serverErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return resp, serverErr
+	}
+	if decodeErr != nil {
+		return resp, decodeErr
+	}
+	return resp, nil
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/nrdp"
+)
+
+// server answers NRDP requests with the responses of reply, recording what it received
+type server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	results  [][]check.Result
+}
+
+func newServer(t *testing.T, reply func(n int, results []check.Result, w http.ResponseWriter)) *server {
+	t.Helper()
+	s := &server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var results []check.Result
+		if data := r.FormValue("JSONDATA"); data != "" {
+			doc, err := check.ParseJSON([]byte(data))
+			if err != nil {
+				t.Errorf("server: invalid JSONDATA: %v", err)
+			}
+			results = doc.CheckResult
+		} else if data := r.FormValue("XMLDATA"); data != "" {
+			doc, err := check.ParseXML([]byte(data))
+			if err != nil {
+				t.Errorf("server: invalid XMLDATA: %v", err)
+			}
+			results = doc.CheckResult
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.results = append(s.results, results)
+		n := len(s.requests)
+		s.mu.Unlock()
+		reply(n, results, w)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newClient(t *testing.T, s *server, opts Options) *Client {
+	t.Helper()
+	opts.URL = s.URL + "/nrdp/"
+	opts.Backoff = time.Millisecond
+	opts.MaxBackoff = 10 * time.Millisecond
+	c, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestNewValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"no URL", Options{}},
+		{"relative URL", Options{URL: "nagios/nrdp"}},
+		{"unknown format", Options{URL: "http://localhost/", Format: "yaml"}},
+		{"negative retries", Options{URL: "http://localhost/", Retries: -1}},
+		{"negative batch size", Options{URL: "http://localhost/", BatchSize: -1}},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.opts); err == nil {
+			t.Errorf("%s: New succeeded", tt.name)
+		}
+	}
+}
+
+func TestSubmitResultsBatches(t *testing.T) {
+	for _, format := range []string{FormatXML, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+				resp := nrdp.OK("OK")
+				resp.Meta = &nrdp.Meta{Accepted: len(results)}
+				if n == 2 {
+					// Reject the first result of the second batch
+					resp.Meta.Accepted--
+					resp.Meta.Rejected = []nrdp.Rejection{{Index: 0, HostName: results[0].HostName, Reason: "unknown host"}}
+				}
+				nrdp.Write(w, http.StatusOK, nrdp.FormatXML, resp)
+			})
+			c := newClient(t, s, Options{Token: "secret", Format: format, BatchSize: 2})
+
+			results := []check.Result{
+				HostResult("web1", 0, "UP"),
+				ServiceResult("web1", "disk", 1, "WARNING"),
+				HostResult("web2", 0, "UP"),
+				ServiceResult("web2", "disk", 0, "OK"),
+				HostResult("web3", 2, "DOWN"),
+			}
+			resp, err := c.SubmitResults(context.Background(), results)
+			if err != nil {
+				t.Fatalf("SubmitResults: %v", err)
+			}
+
+			if len(s.results) != 3 || len(s.results[0]) != 2 || len(s.results[1]) != 2 || len(s.results[2]) != 1 {
+				t.Fatalf("server received batches %v, want 2, 2 and 1 results", s.results)
+			}
+			for _, r := range s.requests {
+				if r.FormValue("token") != "secret" || r.FormValue("cmd") != "submitcheck" || r.FormValue("format") != format {
+					t.Errorf("request form %v", r.Form)
+				}
+			}
+			if got := s.results[2][0]; got.HostName != "web3" || got.State != 2 || got.Output != "DOWN" || got.Time == 0 {
+				t.Errorf("last result = %+v", got)
+			}
+
+			if resp.Status != nrdp.StatusOK || resp.Message != "PARTIAL" || resp.Meta.Accepted != 4 {
+				t.Errorf("response = %+v %+v, want PARTIAL with 4 accepted", resp, resp.Meta)
+			}
+			// The rejection is indexed into the submitted results, not into its batch
+			if len(resp.Meta.Rejected) != 1 || resp.Meta.Rejected[0].Index != 2 || resp.Meta.Rejected[0].HostName != "web2" {
+				t.Errorf("rejected = %+v, want web2 at index 2", resp.Meta.Rejected)
+			}
+		})
+	}
+}
+
+func TestSubmitResultsWithoutMeta(t *testing.T) {
+	// Upstream NRDP only answers with a message
+	s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+		nrdp.Write(w, http.StatusOK, nrdp.FormatXML, nrdp.OK("OK"))
+	})
+	c := newClient(t, s, Options{})
+	results := []check.Result{{Type: check.TypeHost, HostName: "web1", State: 0, Output: "UP"}}
+	resp, err := c.SubmitResults(context.Background(), results)
+	if err != nil {
+		t.Fatalf("SubmitResults: %v", err)
+	}
+	if resp.Message != "OK" || resp.Meta.Accepted != 1 {
+		t.Errorf("response = %+v %+v, want OK with 1 accepted", resp, resp.Meta)
+	}
+	if results[0].Time == 0 {
+		t.Error("result without a timestamp was not stamped")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    []int // Status of each attempt, the last one repeats
+		retries   int
+		wantCalls int
+		wantErr   int // Status code of the returned *Error, 0 for success
+	}{
+		{"succeeds after unavailable", []int{503, 503, 200}, 2, 3, 0},
+		{"succeeds after rate limit", []int{429, 200}, 1, 2, 0},
+		{"gives up after retries", []int{500}, 2, 3, 500},
+		{"no retry on client error", []int{400}, 3, 1, 400},
+		{"no retry on forbidden", []int{403}, 3, 1, 403},
+		{"no retries configured", []int{503}, 0, 1, 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+				code := tt.status[len(tt.status)-1]
+				if n <= len(tt.status) {
+					code = tt.status[n-1]
+				}
+				if code == http.StatusOK {
+					nrdp.Write(w, code, nrdp.FormatXML, nrdp.OK("OK"))
+				} else {
+					nrdp.Write(w, code, nrdp.FormatXML, nrdp.Error("NOPE"))
+				}
+			})
+			c := newClient(t, s, Options{Retries: tt.retries})
+			_, err := c.Hello(context.Background())
+
+			if s.Requests() != tt.wantCalls {
+				t.Errorf("%d requests, want %d", s.Requests(), tt.wantCalls)
+			}
+			if tt.wantErr == 0 {
+				if err != nil {
+					t.Errorf("Hello: %v", err)
+				}
+				return
+			}
+			var serverErr *Error
+			if !errors.As(err, &serverErr) || serverErr.StatusCode != tt.wantErr || serverErr.Response.Message != "NOPE" {
+				t.Errorf("Hello error = %v, want %d NOPE", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "7")
+		nrdp.Write(w, http.StatusTooManyRequests, nrdp.FormatXML, nrdp.Error("RATE LIMITED"))
+	})
+	c := newClient(t, s, Options{Retries: 1})
+
+	start := time.Now()
+	_, err := c.Hello(context.Background())
+	var serverErr *Error
+	if !errors.As(err, &serverErr) || serverErr.RetryAfter != 7*time.Second || !serverErr.Temporary() {
+		t.Fatalf("Hello error = %#v, want a temporary error with Retry-After 7s", err)
+	}
+	// The wait is capped by MaxBackoff
+	if s.Requests() != 2 || time.Since(start) > 5*time.Second {
+		t.Errorf("%d requests in %s, want 2 without waiting the full Retry-After", s.Requests(), time.Since(start))
+	}
+}
+
+func TestErrorStatusInDocument(t *testing.T) {
+	// Upstream NRDP reports a bad token with status 200 and an error document
+	s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+		nrdp.Write(w, http.StatusOK, nrdp.FormatXML, nrdp.Error("BAD TOKEN"))
+	})
+	c := newClient(t, s, Options{Retries: 2})
+	_, err := c.SubmitCommand(context.Background(), "DISABLE_NOTIFICATIONS")
+	var serverErr *Error
+	if !errors.As(err, &serverErr) || serverErr.Temporary() || serverErr.Response.Message != "BAD TOKEN" {
+		t.Fatalf("SubmitCommand error = %v, want BAD TOKEN", err)
+	}
+	if s.Requests() != 1 {
+		t.Errorf("%d requests, want 1", s.Requests())
+	}
+	if got := s.requests[0].FormValue("command"); got != "DISABLE_NOTIFICATIONS" {
+		t.Errorf("command = %q", got)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	s := newServer(t, func(n int, results []check.Result, w http.ResponseWriter) {
+		nrdp.Write(w, http.StatusServiceUnavailable, nrdp.FormatXML, nrdp.Error("BUSY"))
+	})
+	c, err := New(Options{URL: s.URL, Retries: 5, Backoff: time.Hour, MaxBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Hello(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Hello error = %v, want deadline exceeded", err)
+	}
+	if s.Requests() != 1 {
+		t.Errorf("%d requests, want 1", s.Requests())
+	}
+}
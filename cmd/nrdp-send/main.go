@@ -0,0 +1,301 @@
+// Command nrdp-send submits check results to an NRDP server, like send_nrdp.sh.
+//
+// Results are read from stdin as tab-delimited send_nsca-style lines,
+//
+//	host<TAB>service<TAB>state<TAB>output   (service check)
+//	host<TAB>state<TAB>output               (host check)
+//
+// -type host or -type service reads every line as one kind, for host output that
+// contains the delimiter.
+//
+// or as an NRDP JSONDATA or XMLDATA document with -input json/xml. A single result can
+// also be given with -host, -service, -state and -output, and -command sends a Nagios
+// external command instead.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/client"
+	"nrdp_micro/nrdp"
+)
+
+// Exit codes
+const (
+	exitOK     = 0 // All results accepted
+	exitFailed = 1 // The submission failed or some results were rejected
+	exitUsage  = 2 // Invalid flags or input
+)
+
+// maxLineSize is the longest stdin line accepted, as plugin output may carry long text
+const maxLineSize = 1 << 20
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	var (
+		opts      client.Options
+		input     string
+		delimiter string
+		lineType  string
+		host      string
+		service   string
+		state     int
+		output    string
+		command   string
+		hello     bool
+		checkType string
+		caFile    string
+		certFile  string
+		keyFile   string
+		insecure  bool
+		quiet     bool
+	)
+	flag.StringVar(&opts.URL, "url", os.Getenv("NRDP_URL"), "NRDP server URL (default $NRDP_URL)")
+	flag.StringVar(&opts.Token, "token", os.Getenv("NRDP_TOKEN"), "NRDP token (default $NRDP_TOKEN)")
+	flag.StringVar(&opts.Format, "format", client.FormatXML, "Submission format: xml or json")
+	flag.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "Timeout per request attempt")
+	flag.IntVar(&opts.Retries, "retries", 3, "Retries after network errors, 429 and 5xx responses")
+	flag.DurationVar(&opts.Backoff, "backoff", time.Second, "Wait before the first retry, doubled for each further one")
+	flag.IntVar(&opts.BatchSize, "batch", 1000, "Maximum results per request, 0 for no limit")
+	flag.StringVar(&input, "input", "tab", "Stdin format: tab (send_nsca-style lines), json (JSONDATA) or xml (XMLDATA)")
+	flag.StringVar(&delimiter, "d", "\t", "Field delimiter for -input tab")
+	flag.StringVar(&lineType, "type", "auto", "Lines of -input tab: host, service or auto (by field count)")
+	flag.StringVar(&host, "host", "", "Send a single result for this host instead of reading stdin")
+	flag.StringVar(&service, "service", "", "Service of the single result, empty for a host check")
+	flag.IntVar(&state, "state", 0, "State of the single result")
+	flag.StringVar(&output, "output", "", "Plugin output of the single result")
+	flag.StringVar(&checkType, "checktype", "1", "Check type of the results: 1 passive or 0 active")
+	flag.StringVar(&command, "command", "", "Send this Nagios external command instead of check results")
+	flag.BoolVar(&hello, "hello", false, "Only test connectivity with cmd=hello")
+	flag.StringVar(&caFile, "cacert", "", "CA bundle to verify the server certificate")
+	flag.StringVar(&certFile, "cert", "", "Client certificate for mutual TLS")
+	flag.StringVar(&keyFile, "key", "", "Client certificate key for mutual TLS")
+	flag.BoolVar(&insecure, "insecure", false, "Do not verify the server certificate")
+	flag.BoolVar(&quiet, "q", false, "Only print errors")
+	flag.Parse()
+
+	if checkType != "0" && checkType != "1" {
+		fmt.Fprintf(os.Stderr, "nrdp-send: invalid -checktype %q (must be 0 or 1)\n", checkType)
+		return exitUsage
+	}
+
+	tlsConfig, err := newTLSConfig(caFile, certFile, keyFile, insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nrdp-send: %v\n", err)
+		return exitUsage
+	}
+	opts.TLSConfig = tlsConfig
+
+	c, err := client.New(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nrdp-send: %v\n", err)
+		return exitUsage
+	}
+	ctx := context.Background()
+
+	switch {
+	case hello:
+		resp, err := c.Hello(ctx)
+		return report(resp, err, quiet)
+	case command != "":
+		resp, err := c.SubmitCommand(ctx, command)
+		return report(resp, err, quiet)
+	}
+
+	var results []check.Result
+	if host != "" {
+		if service != "" {
+			results = []check.Result{client.ServiceResult(host, service, state, output)}
+		} else {
+			results = []check.Result{client.HostResult(host, state, output)}
+		}
+	} else {
+		results, err = readResults(os.Stdin, input, delimiter, lineType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nrdp-send: %v\n", err)
+			return exitUsage
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(os.Stderr, "nrdp-send: no check results on stdin")
+			return exitUsage
+		}
+	}
+	for i := range results {
+		if results[i].CheckType == "" || host != "" {
+			results[i].CheckType = checkType
+		}
+	}
+
+	resp, err := c.SubmitResults(ctx, results)
+	return report(resp, err, quiet)
+}
+
+// newTLSConfig builds the client TLS settings from the flags, nil when none are set
+func newTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("-cert and -key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// readResults reads check results from r in the given input format
+func readResults(r io.Reader, input, delimiter, lineType string) ([]check.Result, error) {
+	switch input {
+	case "tab":
+		return readDelimited(r, delimiter, lineType)
+	case "json", "xml":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %v", err)
+		}
+		parse := check.ParseJSON
+		if input == "xml" {
+			parse = check.ParseXML
+		}
+		results, err := parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s input: %v", strings.ToUpper(input), err)
+		}
+		return results.CheckResult, nil
+	default:
+		return nil, fmt.Errorf("invalid -input %q (must be tab, json or xml)", input)
+	}
+}
+
+// readDelimited parses send_nsca-style lines: host, service, state and output for service
+// checks, or host, state and output for host checks. lineType "host" or "service" reads
+// every line as that kind; with "auto" lines of four or more fields are service checks,
+// unless only the second field is a state, which makes them host checks whose output
+// contains the delimiter. Blank lines are skipped and the output keeps any further delimiters.
+func readDelimited(r io.Reader, delimiter, lineType string) ([]check.Result, error) {
+	if delimiter == "" {
+		return nil, errors.New("delimiter must not be empty")
+	}
+	if lineType != "auto" && lineType != check.TypeHost && lineType != check.TypeService {
+		return nil, fmt.Errorf("invalid -type %q (must be host, service or auto)", lineType)
+	}
+	var results []check.Result
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, delimiter)
+		kind := lineType
+		if kind == "auto" {
+			kind = check.TypeHost
+			if len(fields) >= 4 && (isState(fields[2]) || !isState(fields[1])) {
+				kind = check.TypeService
+			}
+		}
+
+		var result check.Result
+		switch {
+		case kind == check.TypeService && len(fields) >= 4:
+			state, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid state %q", lineNo, fields[2])
+			}
+			result = client.ServiceResult(fields[0], fields[1], state, strings.Join(fields[3:], delimiter))
+		case kind == check.TypeHost && len(fields) >= 3:
+			state, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid state %q", lineNo, fields[1])
+			}
+			result = client.HostResult(fields[0], state, strings.Join(fields[2:], delimiter))
+		case kind == check.TypeService:
+			return nil, fmt.Errorf("line %d: expected host, service, state and output separated by %q", lineNo, delimiter)
+		case lineType == check.TypeHost:
+			return nil, fmt.Errorf("line %d: expected host, state and output separated by %q", lineNo, delimiter)
+		default:
+			return nil, fmt.Errorf("line %d: expected host, [service,] state and output separated by %q", lineNo, delimiter)
+		}
+		result.CheckType = "" // Set from -checktype by the caller
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stdin: %v", err)
+	}
+	return results, nil
+}
+
+// isState reports whether field holds a numeric check state
+func isState(field string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(field))
+	return err == nil
+}
+
+// report prints the outcome and returns the exit code
+func report(resp nrdp.Response, err error, quiet bool) int {
+	var serverErr *client.Error
+	if errors.As(err, &serverErr) {
+		resp = serverErr.Response
+	}
+	if resp.Meta != nil {
+		for _, rejection := range resp.Meta.Rejected {
+			name := rejection.HostName
+			if rejection.ServiceName != "" {
+				name += "/" + rejection.ServiceName
+			}
+			fmt.Fprintf(os.Stderr, "nrdp-send: result %d (%s) rejected: %s\n", rejection.Index, name, rejection.Reason)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nrdp-send: %v\n", err)
+		return exitFailed
+	}
+
+	if !quiet {
+		switch {
+		case resp.Meta != nil:
+			fmt.Println(resp.Meta.Output)
+		case resp.Product != "":
+			fmt.Printf("%s: %s %s\n", resp.Message, resp.Product, resp.Version)
+		default:
+			fmt.Println(resp.Message)
+		}
+	}
+	if resp.Meta != nil && len(resp.Meta.Rejected) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"nrdp_micro/check"
+)
+
+func TestReadDelimited(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		lineType string
+		want     []check.Result
+		wantErr  bool
+	}{
+		{
+			name:     "service and host lines",
+			input:    "web01\tdisk\t1\tWARNING\nweb01\t0\tUP\n\n",
+			lineType: "auto",
+			want: []check.Result{
+				{Type: check.TypeService, HostName: "web01", ServiceName: "disk", State: 1, Output: "WARNING"},
+				{Type: check.TypeHost, HostName: "web01", State: 0, Output: "UP"},
+			},
+		},
+		{
+			name:     "service output with delimiters",
+			input:    "web01\tdisk\t1\tWARNING\tsee\tdetails\n",
+			lineType: "auto",
+			want:     []check.Result{{Type: check.TypeService, HostName: "web01", ServiceName: "disk", State: 1, Output: "WARNING\tsee\tdetails"}},
+		},
+		{
+			name:     "host output with delimiters",
+			input:    "web01\t0\tUP\tsince 3 days\n",
+			lineType: "auto",
+			want:     []check.Result{{Type: check.TypeHost, HostName: "web01", State: 0, Output: "UP\tsince 3 days"}},
+		},
+		{
+			name:     "numeric service name",
+			input:    "web01\t443\t2\tCRITICAL\n",
+			lineType: "auto",
+			want:     []check.Result{{Type: check.TypeService, HostName: "web01", ServiceName: "443", State: 2, Output: "CRITICAL"}},
+		},
+		{
+			name:     "forced host",
+			input:    "web01\t1\t2\t3\n",
+			lineType: "host",
+			want:     []check.Result{{Type: check.TypeHost, HostName: "web01", State: 1, Output: "2\t3"}},
+		},
+		{
+			name:     "forced service",
+			input:    "web01\t1\t2\tx\n",
+			lineType: "service",
+			want:     []check.Result{{Type: check.TypeService, HostName: "web01", ServiceName: "1", State: 2, Output: "x"}},
+		},
+		{name: "forced service with three fields", input: "web01\t0\tUP\n", lineType: "service", wantErr: true},
+		{name: "invalid state", input: "web01\tdisk\tbad\tOK\n", lineType: "auto", wantErr: true},
+		{name: "too few fields", input: "web01\t0\n", lineType: "auto", wantErr: true},
+		{name: "invalid type", input: "web01\t0\tUP\n", lineType: "both", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readDelimited(strings.NewReader(tt.input), "\t", tt.lineType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readDelimited() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("readDelimited() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.Type != w.Type || g.HostName != w.HostName || g.ServiceName != w.ServiceName || g.State != w.State || g.Output != w.Output {
+					t.Errorf("result %d = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
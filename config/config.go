@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -19,20 +22,75 @@ type NagiosConfig struct {
 	GenerationInterval string `yaml:"generation_interval"`
 	StaleThreshold     string `yaml:"stale_threshold"`
 	ReloadCommand      string `yaml:"reload_command,omitempty"` // Command to execute on reload
+	CommandFile        string `yaml:"command_file,omitempty"`   // Nagios external command file, empty disables submitcmd
+	CommandTimeout     string `yaml:"command_timeout"`          // Maximum time to wait for a command file write
+}
+
+// Token is an accepted NRDP token. In YAML it is either a plain string or a mapping
+// that also limits the hostnames submitted with the token.
+type Token struct {
+	Token      string   `yaml:"token"`
+	Hosts      []string `yaml:"hosts,omitempty"`       // Hostname globs or /regexps/, empty allows any host
+	HostPrefix string   `yaml:"host_prefix,omitempty"` // Prepended to submitted hostnames before matching hosts
+}
+
+// UnmarshalYAML accepts both "secret" and {token: secret, hosts: [...], host_prefix: ...}
+func (t *Token) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = Token{}
+		return value.Decode(&t.Token)
+	}
+	type plain Token // prevents recursion into UnmarshalYAML
+	return value.Decode((*plain)(t))
 }
 
 // Config represents the application configuration
 type Config struct {
 	Server struct {
-		ListenAddr string `yaml:"listen_addr"`
+		ListenAddr      string  `yaml:"listen_addr"`
+		ShutdownTimeout string  `yaml:"shutdown_timeout"` // Longest wait for in-flight requests on shutdown
+		Tokens          []Token `yaml:"tokens"`           // Accepted NRDP tokens, empty disables authentication
+		MetricsPath     string  `yaml:"metrics_path"`     // Prometheus metrics endpoint, empty disables it
+		// Export the latest state and perfdata of every host/service on the metrics endpoint
+		MetricsCheckStates bool     `yaml:"metrics_check_states"`
+		MetricsMaxSeries   int      `yaml:"metrics_max_series"` // Most hosts/services and perfdata values exported with metrics_check_states
+		TrustedProxies     []string `yaml:"trusted_proxies"`    // Proxies whose X-Forwarded-For is honoured
+		Access             struct {
+			Allow []string `yaml:"allow"` // CIDRs allowed to submit, empty allows all not denied
+			Deny  []string `yaml:"deny"`  // CIDRs refused, takes precedence over allow
+		} `yaml:"access"`
+		RateLimit struct {
+			By                []string `yaml:"by"` // Keys limited separately: "ip" and/or "token"
+			RequestsPerSecond float64  `yaml:"requests_per_second"`
+			RequestBurst      int      `yaml:"request_burst"`
+			ResultsPerSecond  float64  `yaml:"results_per_second"`
+			ResultBurst       int      `yaml:"result_burst"`
+		} `yaml:"rate_limit"`
+		TLS struct {
+			Enabled        bool   `yaml:"enabled"`
+			CertFile       string `yaml:"cert_file"`
+			KeyFile        string `yaml:"key_file"`
+			MinVersion     string `yaml:"min_version"`     // "1.2" or "1.3"
+			ReloadInterval string `yaml:"reload_interval"` // How often cert_file/key_file are checked for changes, "0" disables
+			ClientCAFile   string `yaml:"client_ca_file"`  // CA bundle for client certificates, empty disables mTLS
+			ClientAuth     string `yaml:"client_auth"`     // "require" or "optional" client certificates
+			// Client certificate CN or DNS SAN -> hostname patterns that client may submit for
+			ClientHosts map[string][]string `yaml:"client_hosts"`
+		} `yaml:"tls"`
 	} `yaml:"server"`
 
 	Storage struct {
-		OutputDir     string  `yaml:"output_dir"`
-		GroupName     string  `yaml:"group_name"`
-		MaxFiles      int     `yaml:"max_files"`
-		MinDiskSpace  float64 `yaml:"min_disk_space_percent"`
-		PauseDuration string  `yaml:"pause_duration"`
+		OutputDir     string   `yaml:"output_dir"`
+		GroupName     string   `yaml:"group_name"`
+		MaxFiles      int      `yaml:"max_files"`
+		MinDiskSpace  float64  `yaml:"min_disk_space_percent"`
+		PauseDuration string   `yaml:"pause_duration"` // Retry-After sent to clients while the spool is full
+		Sinks         []string `yaml:"sinks"`          // Result destinations in order: "spool", "command_file", "perfdata_export"
+		Batch         struct {
+			Mode       string `yaml:"mode"`        // "none", "request" or "window"
+			MaxResults int    `yaml:"max_results"` // Maximum results per spool file
+			MaxDelay   string `yaml:"max_delay"`   // Window mode: longest a result waits for its batch
+		} `yaml:"batch"`
 	} `yaml:"storage"`
 
 	Logging struct {
@@ -41,8 +99,31 @@ type Config struct {
 		ShowRaw bool   `yaml:"show_raw"`
 	} `yaml:"logging"`
 
-	DatabasePath string       `yaml:"database_path"`
-	Nagios       NagiosConfig `yaml:"nagios"`
+	Queue struct {
+		Enabled     bool   `yaml:"enabled"`
+		Dir         string `yaml:"dir"`
+		SegmentSize int64  `yaml:"segment_size"` // Bytes per segment file before rotating
+		MaxSize     int64  `yaml:"max_size"`     // Bytes of unprocessed results before rejecting submissions
+	} `yaml:"queue"`
+
+	PerfDataExport struct {
+		Format        string `yaml:"format"`         // "graphite" plaintext or "influx" line protocol
+		Protocol      string `yaml:"protocol"`       // "tcp", "udp" or "http"
+		Address       string `yaml:"address"`        // host:port, or the write URL for http
+		Prefix        string `yaml:"prefix"`         // Graphite path prefix or InfluxDB measurement
+		BatchSize     int    `yaml:"batch_size"`     // Lines sent per write
+		FlushInterval string `yaml:"flush_interval"` // Longest time a line waits before being sent
+		BufferSize    int    `yaml:"buffer_size"`    // Lines kept for retry while the endpoint is down
+		Timeout       string `yaml:"timeout"`        // Connect and write timeout
+	} `yaml:"perfdata_export"`
+
+	DatabasePath  string `yaml:"database_path"`
+	DatabaseBatch struct {
+		Mode       string `yaml:"mode"`        // "request" writes each submission in one transaction, "window" also coalesces concurrent submissions
+		MaxUpdates int    `yaml:"max_updates"` // Window mode: most check results written per transaction
+		MaxDelay   string `yaml:"max_delay"`   // Window mode: longest a submission waits for its transaction
+	} `yaml:"database_batch"`
+	Nagios NagiosConfig `yaml:"nagios"`
 }
 
 // DefaultConfig returns the default configuration
@@ -51,6 +132,16 @@ func DefaultConfig() *Config {
 
 	// Server defaults
 	cfg.Server.ListenAddr = ":8080"
+	cfg.Server.ShutdownTimeout = "30s"
+	cfg.Server.MetricsPath = "/metrics"
+	cfg.Server.MetricsCheckStates = false // Would publish every host and service
+	cfg.Server.MetricsMaxSeries = 10000
+	cfg.Server.RateLimit.By = []string{"ip"}
+	cfg.Server.RateLimit.RequestBurst = 20
+	cfg.Server.RateLimit.ResultBurst = 5000
+	cfg.Server.TLS.MinVersion = "1.2"
+	cfg.Server.TLS.ReloadInterval = "1m"
+	cfg.Server.TLS.ClientAuth = "require"
 
 	// Storage defaults
 	cfg.Storage.OutputDir = "/var/lib/nagios4/spool/checkresults"
@@ -58,6 +149,26 @@ func DefaultConfig() *Config {
 	cfg.Storage.MaxFiles = 1000
 	cfg.Storage.MinDiskSpace = 5.0 // 5% minimum free space
 	cfg.Storage.PauseDuration = "10s"
+	cfg.Storage.Sinks = []string{"spool"}
+	cfg.Storage.Batch.Mode = "none"
+	cfg.Storage.Batch.MaxResults = 500
+	cfg.Storage.Batch.MaxDelay = "200ms"
+
+	// Queue defaults
+	cfg.Queue.Enabled = false
+	cfg.Queue.Dir = "./nrdp_queue"
+	cfg.Queue.SegmentSize = 16 << 20 // 16MB
+	cfg.Queue.MaxSize = 1 << 30      // 1GB
+
+	// Perfdata export defaults
+	cfg.PerfDataExport.Format = "graphite"
+	cfg.PerfDataExport.Protocol = "tcp"
+	cfg.PerfDataExport.Address = "127.0.0.1:2003"
+	cfg.PerfDataExport.Prefix = "nagios"
+	cfg.PerfDataExport.BatchSize = 500
+	cfg.PerfDataExport.FlushInterval = "10s"
+	cfg.PerfDataExport.BufferSize = 100000
+	cfg.PerfDataExport.Timeout = "5s"
 
 	// Logging defaults
 	cfg.Logging.Level = "info"
@@ -66,6 +177,9 @@ func DefaultConfig() *Config {
 
 	// Database defaults
 	cfg.DatabasePath = "./nrdp_checks.db" // Sensible default
+	cfg.DatabaseBatch.Mode = "request"
+	cfg.DatabaseBatch.MaxUpdates = 1000
+	cfg.DatabaseBatch.MaxDelay = "50ms"
 
 	// Nagios config defaults
 	cfg.Nagios.OutputDir = "/etc/nagios4/dynamic"  // Default dynamic dir
@@ -73,6 +187,8 @@ func DefaultConfig() *Config {
 	cfg.Nagios.ServiceTemplate = "generic-service" // Common default template
 	cfg.Nagios.GenerationInterval = "30s"          // Default interval (30 seconds)
 	cfg.Nagios.StaleThreshold = "6h"               // Default stale threshold (6 hours)
+	cfg.Nagios.CommandFile = "/var/lib/nagios4/rw/nagios.cmd"
+	cfg.Nagios.CommandTimeout = "5s"
 
 	return cfg
 }
@@ -112,12 +228,47 @@ func Load(configPath string) (*Config, error) {
 	return cfg, nil
 }
 
-// Validate checks if the configuration is valid
+// Components selects the parts of the configuration a server actually uses. An embedding
+// application that supplies its own sinks or status store, or does not generate Nagios
+// config, does not need the corresponding directories to exist.
+type Components struct {
+	Spool        bool // storage.output_dir receives spool files
+	Database     bool // database_path holds the SQLite status database
+	NagiosConfig bool // nagios.output_dir receives generated object config
+}
+
+// Validate checks if the configuration is valid, including every directory it names
 func (c *Config) Validate() error {
+	return c.ValidateFor(Components{Spool: true, Database: true, NagiosConfig: true})
+}
+
+// ValidateFor checks if the configuration is valid, skipping the directory checks of
+// components that are not used
+func (c *Config) ValidateFor(used Components) error {
 	if c.Server.ListenAddr == "" {
 		return errors.New("server listen_addr must be specified")
 	}
-	if c.Storage.OutputDir == "" {
+	if d, err := time.ParseDuration(c.Server.ShutdownTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid server shutdown_timeout: %s", c.Server.ShutdownTimeout)
+	}
+	for i, token := range c.Server.Tokens {
+		if token.Token == "" {
+			return fmt.Errorf("server tokens[%d] must not be empty", i)
+		}
+	}
+	if c.Server.MetricsMaxSeries <= 0 {
+		return errors.New("server metrics_max_series must be greater than 0")
+	}
+	if c.Server.MetricsPath != "" && (!strings.HasPrefix(c.Server.MetricsPath, "/") || c.Server.MetricsPath == "/") {
+		return fmt.Errorf("invalid server metrics_path: %s (must be an absolute path other than /)", c.Server.MetricsPath)
+	}
+	if err := c.validateRateLimit(); err != nil {
+		return err
+	}
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	if used.Spool && c.Storage.OutputDir == "" {
 		return errors.New("storage output_dir must be specified")
 	}
 	if c.Storage.MaxFiles < 0 {
@@ -129,29 +280,22 @@ func (c *Config) Validate() error {
 	if c.Logging.Level != "info" && c.Logging.Level != "debug" && c.Logging.Level != "trace" {
 		return fmt.Errorf("invalid logging level: %s (must be info, debug, or trace)", c.Logging.Level)
 	}
-	if c.DatabasePath == "" {
-		return errors.New("database_path must be specified")
-	}
-	dbDir := filepath.Dir(c.DatabasePath)
-	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
-		// Attempt to create the directory if using default relative path
-		if c.DatabasePath == "./nrdp_checks.db" {
-			if err := os.MkdirAll(dbDir, 0755); err != nil {
-				return fmt.Errorf("failed to create default database directory %s: %w", dbDir, err)
-			}
-		} else {
-			return fmt.Errorf("database directory does not exist: %s", dbDir)
+	if used.Database {
+		if err := c.validateDatabasePath(); err != nil {
+			return err
 		}
 	}
 
-	// Check if output directory exists
-	if _, err := os.Stat(c.Storage.OutputDir); os.IsNotExist(err) {
-		return fmt.Errorf("output directory does not exist: %s", c.Storage.OutputDir)
-	}
+	if used.Spool {
+		// Check if output directory exists
+		if _, err := os.Stat(c.Storage.OutputDir); os.IsNotExist(err) {
+			return fmt.Errorf("output directory does not exist: %s", c.Storage.OutputDir)
+		}
 
-	// Check if output directory is absolute path
-	if !filepath.IsAbs(c.Storage.OutputDir) {
-		return fmt.Errorf("output directory must be an absolute path: %s", c.Storage.OutputDir)
+		// Check if output directory is absolute path
+		if !filepath.IsAbs(c.Storage.OutputDir) {
+			return fmt.Errorf("output directory must be an absolute path: %s", c.Storage.OutputDir)
+		}
 	}
 
 	// Validate min disk space percentage
@@ -169,16 +313,82 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid storage pause_duration: %v", err)
 	}
 
-	// Validate Nagios config section
-	if c.Nagios.OutputDir == "" {
-		return errors.New("nagios_config output_dir must be specified")
+	// Validate sink selection
+	if len(c.Storage.Sinks) == 0 {
+		return errors.New("storage sinks must list at least one sink")
+	}
+	seenSinks := make(map[string]bool)
+	for _, sink := range c.Storage.Sinks {
+		switch sink {
+		case "spool":
+		case "command_file":
+			if c.Nagios.CommandFile == "" {
+				return errors.New("storage sink command_file requires nagios command_file to be set")
+			}
+		case "perfdata_export":
+			if err := c.validatePerfDataExport(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid storage sink: %s (must be spool, command_file or perfdata_export)", sink)
+		}
+		if seenSinks[sink] {
+			return fmt.Errorf("storage sink %s listed more than once", sink)
+		}
+		seenSinks[sink] = true
+	}
+
+	// Validate spool batching
+	switch c.Storage.Batch.Mode {
+	case "none", "request", "window":
+	default:
+		return fmt.Errorf("invalid storage batch mode: %s (must be none, request or window)", c.Storage.Batch.Mode)
+	}
+	if c.Storage.Batch.MaxResults <= 0 {
+		return errors.New("storage batch max_results must be greater than 0")
+	}
+	if d, err := time.ParseDuration(c.Storage.Batch.MaxDelay); err != nil || d <= 0 {
+		return fmt.Errorf("invalid storage batch max_delay: %s", c.Storage.Batch.MaxDelay)
+	}
+
+	// Validate database write batching
+	switch c.DatabaseBatch.Mode {
+	case "request", "window":
+	default:
+		return fmt.Errorf("invalid database_batch mode: %s (must be request or window)", c.DatabaseBatch.Mode)
 	}
-	if !filepath.IsAbs(c.Nagios.OutputDir) {
-		return fmt.Errorf("nagios_config output_dir must be an absolute path: %s", c.Nagios.OutputDir)
+	if c.DatabaseBatch.MaxUpdates <= 0 {
+		return errors.New("database_batch max_updates must be greater than 0")
+	}
+	if d, err := time.ParseDuration(c.DatabaseBatch.MaxDelay); err != nil || d <= 0 {
+		return fmt.Errorf("invalid database_batch max_delay: %s", c.DatabaseBatch.MaxDelay)
+	}
+
+	// Validate ingest queue
+	if c.Queue.Enabled {
+		if c.Queue.Dir == "" {
+			return errors.New("queue dir must be specified")
+		}
+		if c.Queue.SegmentSize <= 0 {
+			return errors.New("queue segment_size must be greater than 0")
+		}
+		if c.Queue.MaxSize < 0 {
+			return errors.New("queue max_size cannot be negative")
+		}
 	}
-	// Check if Nagios output directory exists and is writable
-	if err := checkDirWritable(c.Nagios.OutputDir); err != nil {
-		return fmt.Errorf("nagios_config output_dir check failed: %w", err)
+
+	// Validate Nagios config section
+	if used.NagiosConfig {
+		if c.Nagios.OutputDir == "" {
+			return errors.New("nagios_config output_dir must be specified")
+		}
+		if !filepath.IsAbs(c.Nagios.OutputDir) {
+			return fmt.Errorf("nagios_config output_dir must be an absolute path: %s", c.Nagios.OutputDir)
+		}
+		// Check if Nagios output directory exists and is writable
+		if err := checkDirWritable(c.Nagios.OutputDir); err != nil {
+			return fmt.Errorf("nagios_config output_dir check failed: %w", err)
+		}
 	}
 	if c.Nagios.HostTemplate == "" {
 		return errors.New("nagios_config host_template must be specified")
@@ -193,11 +403,117 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid nagios_config stale_threshold: %v", err)
 	}
 
+	if _, err := time.ParseDuration(c.Nagios.CommandTimeout); err != nil {
+		return fmt.Errorf("invalid nagios_config command_timeout: %v", err)
+	}
+
 	// Note: No validation needed for ReloadCommand, empty means disabled.
 
 	return nil
 }
 
+// validateDatabasePath checks that the directory of the SQLite database exists,
+// creating it for the default relative path
+func (c *Config) validateDatabasePath() error {
+	if c.DatabasePath == "" {
+		return errors.New("database_path must be specified")
+	}
+	dbDir := filepath.Dir(c.DatabasePath)
+	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
+		// Attempt to create the directory if using default relative path
+		if c.DatabasePath == "./nrdp_checks.db" {
+			if err := os.MkdirAll(dbDir, 0755); err != nil {
+				return fmt.Errorf("failed to create default database directory %s: %w", dbDir, err)
+			}
+		} else {
+			return fmt.Errorf("database directory does not exist: %s", dbDir)
+		}
+	}
+	return nil
+}
+
+// validateRateLimit checks the server rate_limit section; zero rates disable the limits
+func (c *Config) validateRateLimit() error {
+	limit := c.Server.RateLimit
+	if limit.RequestsPerSecond < 0 || limit.ResultsPerSecond < 0 {
+		return errors.New("server rate_limit rates cannot be negative")
+	}
+	if limit.RequestBurst < 0 || limit.ResultBurst < 0 {
+		return errors.New("server rate_limit bursts cannot be negative")
+	}
+	if (limit.RequestsPerSecond > 0 || limit.ResultsPerSecond > 0) && len(limit.By) == 0 {
+		return errors.New("server rate_limit by must list ip and/or token")
+	}
+	seen := make(map[string]bool)
+	for _, by := range limit.By {
+		if by != "ip" && by != "token" {
+			return fmt.Errorf("invalid server rate_limit by: %s (must be ip or token)", by)
+		}
+		if seen[by] {
+			return fmt.Errorf("server rate_limit by %s listed more than once", by)
+		}
+		seen[by] = true
+	}
+	return nil
+}
+
+// validateTLS checks the server tls section when TLS is enabled
+func (c *Config) validateTLS() error {
+	t := c.Server.TLS
+	if !t.Enabled {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errors.New("server tls cert_file and key_file must be specified")
+	}
+	if t.MinVersion != "1.2" && t.MinVersion != "1.3" {
+		return fmt.Errorf("invalid server tls min_version: %s (must be 1.2 or 1.3)", t.MinVersion)
+	}
+	if d, err := time.ParseDuration(t.ReloadInterval); err != nil || d < 0 {
+		return fmt.Errorf("invalid server tls reload_interval: %s", t.ReloadInterval)
+	}
+	if t.ClientAuth != "require" && t.ClientAuth != "optional" {
+		return fmt.Errorf("invalid server tls client_auth: %s (must be require or optional)", t.ClientAuth)
+	}
+	if len(t.ClientHosts) > 0 && t.ClientCAFile == "" {
+		return errors.New("server tls client_hosts requires client_ca_file")
+	}
+	return nil
+}
+
+// validatePerfDataExport checks the perfdata_export section when the sink is in use
+func (c *Config) validatePerfDataExport() error {
+	export := c.PerfDataExport
+	if export.Format != "graphite" && export.Format != "influx" {
+		return fmt.Errorf("invalid perfdata_export format: %s (must be graphite or influx)", export.Format)
+	}
+	switch export.Protocol {
+	case "tcp", "udp":
+		if _, _, err := net.SplitHostPort(export.Address); err != nil {
+			return fmt.Errorf("invalid perfdata_export address %q: %v", export.Address, err)
+		}
+	case "http":
+		if u, err := url.Parse(export.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid perfdata_export address %q: must be an http(s) URL", export.Address)
+		}
+	default:
+		return fmt.Errorf("invalid perfdata_export protocol: %s (must be tcp, udp or http)", export.Protocol)
+	}
+	if export.BatchSize <= 0 {
+		return errors.New("perfdata_export batch_size must be greater than 0")
+	}
+	if export.BufferSize < export.BatchSize {
+		return errors.New("perfdata_export buffer_size must be at least batch_size")
+	}
+	if d, err := time.ParseDuration(export.FlushInterval); err != nil || d <= 0 {
+		return fmt.Errorf("invalid perfdata_export flush_interval: %s", export.FlushInterval)
+	}
+	if d, err := time.ParseDuration(export.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid perfdata_export timeout: %s", export.Timeout)
+	}
+	return nil
+}
+
 // checkDirWritable checks if a directory exists and is writable.
 // Tries to create it if it doesn't exist.
 func checkDirWritable(dir string) error {
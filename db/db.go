@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -25,6 +26,63 @@ type Service struct {
 	LastSeen           time.Time
 }
 
+// CheckState represents a row in the check_states table: the latest result of a host or service
+type CheckState struct {
+	Hostname           string
+	ServiceDescription string // Empty for host check results
+	State              int
+	LastSeen           time.Time
+}
+
+// PerfData represents a row in the perfdata table: the latest value of one metric
+type PerfData struct {
+	Hostname           string
+	ServiceDescription string // Empty for host check results
+	Label              string
+	Value              float64
+	UOM                string
+	Warn               string
+	Crit               string
+	Min                *float64
+	Max                *float64
+	Updated            time.Time
+}
+
+// Update is the status recorded for one accepted check result: the host and service
+// last_seen times, the latest state and the performance data
+type Update struct {
+	Hostname           string
+	ServiceDescription string // Empty for host check results
+	State              int
+	PerfData           []PerfData
+	Time               time.Time
+}
+
+// Store is the status storage used by the NRDP handler, the config generator and the
+// metrics endpoint. Manager implements it with SQLite; embedding applications may
+// supply their own implementation.
+type Store interface {
+	ApplyUpdates(updates []Update) error
+
+	GetAllHosts() ([]Host, error)
+	GetAllServices() ([]Service, error)
+	GetAllCheckStates() ([]CheckState, error)
+	GetAllPerfData() ([]PerfData, error)
+
+	DeleteStaleHosts(threshold time.Time) (int64, error)
+	DeleteStaleServices(threshold time.Time) (int64, error)
+	DeleteStalePerfData(threshold time.Time) (int64, error)
+	DeleteStaleCheckStates(threshold time.Time) (int64, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var _ Store = (*Manager)(nil)
+
+// busyTimeout is how long a write waits for another connection's lock
+const busyTimeout = 5 * time.Second
+
 // Manager handles database operations
 type Manager struct {
 	db *sql.DB
@@ -40,13 +98,26 @@ func NewManager(dbPath string) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create database directory %s: %w", dbDir, err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// WAL lets the metrics endpoint and config generator read while submissions are
+	// written, and busy_timeout makes concurrent writers wait for the lock instead of
+	// failing with SQLITE_BUSY. They are DSN parameters so every pooled connection gets them.
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d", dbPath, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
 	}
 
 	m := &Manager{db: db}
 
+	var journalMode string
+	if err := db.QueryRow(`PRAGMA journal_mode;`).Scan(&journalMode); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
+	}
+	if journalMode != "wal" {
+		logger.Logf(logger.LevelInfo, "Warning: database %s uses journal mode %s, WAL is not available", dbPath, journalMode)
+	}
+
 	if err := m.initSchema(); err != nil {
 		db.Close() // Close the connection if schema init fails
 		return nil, fmt.Errorf("failed to initialize database schema: %w", err)
@@ -82,45 +153,178 @@ func (m *Manager) initSchema() error {
 	}
 	logger.Logf(logger.LevelDebug, "Services table checked/created.")
 
+	createPerfDataTable := `
+	CREATE TABLE IF NOT EXISTS perfdata (
+		hostname TEXT NOT NULL,
+		service_description TEXT NOT NULL,
+		label TEXT NOT NULL,
+		value REAL NOT NULL,
+		uom TEXT NOT NULL DEFAULT '',
+		warn TEXT NOT NULL DEFAULT '',
+		crit TEXT NOT NULL DEFAULT '',
+		min REAL,
+		max REAL,
+		updated INTEGER NOT NULL,
+		PRIMARY KEY (hostname, service_description, label)
+	);`
+	_, err = m.db.Exec(createPerfDataTable)
+	if err != nil {
+		return fmt.Errorf("failed to create perfdata table: %w", err)
+	}
+	logger.Logf(logger.LevelDebug, "Perfdata table checked/created.")
+
+	createCheckStatesTable := `
+	CREATE TABLE IF NOT EXISTS check_states (
+		hostname TEXT NOT NULL,
+		service_description TEXT NOT NULL,
+		state INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (hostname, service_description)
+	);`
+	_, err = m.db.Exec(createCheckStatesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create check_states table: %w", err)
+	}
+	logger.Logf(logger.LevelDebug, "Check states table checked/created.")
+
 	return nil
 }
 
-// UpdateHost updates the last_seen timestamp for a given host.
-// If the host doesn't exist, it's inserted.
-func (m *Manager) UpdateHost(hostname string, lastSeen time.Time) error {
-	unixTime := lastSeen.Unix()
-	query := `
-	INSERT INTO hosts (hostname, last_seen)
-	VALUES (?, ?)
-	ON CONFLICT(hostname) DO UPDATE SET last_seen = excluded.last_seen;
-	`
-	_, err := m.db.Exec(query, hostname, unixTime)
+// GetAllCheckStates retrieves the latest state of all hosts and services.
+func (m *Manager) GetAllCheckStates() ([]CheckState, error) {
+	query := `SELECT hostname, service_description, state, last_seen FROM check_states ORDER BY hostname, service_description;`
+	rows, err := m.db.Query(query)
 	if err != nil {
-		logger.Logf(logger.LevelDebug, "Failed to update host %s: %v", hostname, err)
-		return fmt.Errorf("failed to update host %s: %w", hostname, err)
+		return nil, fmt.Errorf("failed to query check states: %w", err)
 	}
-	logger.Logf(logger.LevelTrace, "Updated host %s last_seen to %d", hostname, unixTime)
-	return nil
+	defer rows.Close()
+
+	var states []CheckState
+	for rows.Next() {
+		var c CheckState
+		var lastSeenUnix int64
+		if err := rows.Scan(&c.Hostname, &c.ServiceDescription, &c.State, &lastSeenUnix); err != nil {
+			return nil, fmt.Errorf("failed to scan check state row: %w", err)
+		}
+		c.LastSeen = time.Unix(lastSeenUnix, 0)
+		states = append(states, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during check state rows iteration: %w", err)
+	}
+
+	return states, nil
 }
 
-// UpdateService updates the last_seen timestamp for a given host and service description.
-// If the service doesn't exist, it's inserted.
-func (m *Manager) UpdateService(hostname, serviceDescription string, lastSeen time.Time) error {
-	unixTime := lastSeen.Unix()
-	query := `
-	INSERT INTO services (hostname, service_description, last_seen)
-	VALUES (?, ?, ?)
-	ON CONFLICT(hostname, service_description) DO UPDATE SET last_seen = excluded.last_seen;
-	`
-	_, err := m.db.Exec(query, hostname, serviceDescription, unixTime)
+// ApplyUpdates records the status of a batch of check results in a single transaction
+// with prepared statements, instead of committing every host, service, state and
+// perfdata row separately. Later updates for the same host or service win.
+func (m *Manager) ApplyUpdates(updates []Update) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin status transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op after a successful commit
+
+	var stmts []*sql.Stmt
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}()
+	prepare := func(query string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		if stmt, err = tx.Prepare(query); err == nil {
+			stmts = append(stmts, stmt)
+		}
+		return stmt
+	}
+	hostStmt := prepare(`INSERT INTO hosts (hostname, last_seen) VALUES (?, ?)
+		ON CONFLICT(hostname) DO UPDATE SET last_seen = excluded.last_seen;`)
+	serviceStmt := prepare(`INSERT INTO services (hostname, service_description, last_seen) VALUES (?, ?, ?)
+		ON CONFLICT(hostname, service_description) DO UPDATE SET last_seen = excluded.last_seen;`)
+	stateStmt := prepare(`INSERT INTO check_states (hostname, service_description, state, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT(hostname, service_description) DO UPDATE SET state = excluded.state, last_seen = excluded.last_seen;`)
+	clearPerfStmt := prepare(`DELETE FROM perfdata WHERE hostname = ? AND service_description = ?;`)
+	perfStmt := prepare(`INSERT OR REPLACE INTO perfdata (hostname, service_description, label, value, uom, warn, crit, min, max, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	if err != nil {
-		logger.Logf(logger.LevelDebug, "Failed to update service '%s' on host %s: %v", serviceDescription, hostname, err)
-		return fmt.Errorf("failed to update service '%s' on host %s: %w", serviceDescription, hostname, err)
+		return fmt.Errorf("failed to prepare status statements: %w", err)
 	}
-	logger.Logf(logger.LevelTrace, "Updated service '%s' on host %s last_seen to %d", serviceDescription, hostname, unixTime)
+
+	for _, u := range updates {
+		unixTime := u.Time.Unix()
+		if _, err := hostStmt.Exec(u.Hostname, unixTime); err != nil {
+			return fmt.Errorf("failed to update host %s: %w", u.Hostname, err)
+		}
+		if u.ServiceDescription != "" {
+			if _, err := serviceStmt.Exec(u.Hostname, u.ServiceDescription, unixTime); err != nil {
+				return fmt.Errorf("failed to update service '%s' on host %s: %w", u.ServiceDescription, u.Hostname, err)
+			}
+		}
+		if _, err := stateStmt.Exec(u.Hostname, u.ServiceDescription, u.State, unixTime); err != nil {
+			return fmt.Errorf("failed to update state of '%s' on host %s: %w", u.ServiceDescription, u.Hostname, err)
+		}
+		// Replace the stored perfdata so labels the plugin no longer reports are removed
+		if _, err := clearPerfStmt.Exec(u.Hostname, u.ServiceDescription); err != nil {
+			return fmt.Errorf("failed to clear perfdata for '%s' on host %s: %w", u.ServiceDescription, u.Hostname, err)
+		}
+		for _, d := range u.PerfData {
+			if _, err := perfStmt.Exec(u.Hostname, u.ServiceDescription, d.Label, d.Value, d.UOM, d.Warn, d.Crit, d.Min, d.Max, unixTime); err != nil {
+				return fmt.Errorf("failed to store perfdata '%s' for '%s' on host %s: %w", d.Label, u.ServiceDescription, u.Hostname, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit status of %d check results: %w", len(updates), err)
+	}
+	logger.Logf(logger.LevelTrace, "Stored status of %d check results", len(updates))
 	return nil
 }
 
+// GetAllPerfData retrieves the latest performance data of all hosts and services.
+func (m *Manager) GetAllPerfData() ([]PerfData, error) {
+	query := `SELECT hostname, service_description, label, value, uom, warn, crit, min, max, updated
+	FROM perfdata ORDER BY hostname, service_description, label;`
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query perfdata: %w", err)
+	}
+	defer rows.Close()
+
+	var data []PerfData
+	for rows.Next() {
+		var d PerfData
+		var min, max sql.NullFloat64
+		var updatedUnix int64
+		if err := rows.Scan(&d.Hostname, &d.ServiceDescription, &d.Label, &d.Value, &d.UOM, &d.Warn, &d.Crit, &min, &max, &updatedUnix); err != nil {
+			return nil, fmt.Errorf("failed to scan perfdata row: %w", err)
+		}
+		if min.Valid {
+			d.Min = &min.Float64
+		}
+		if max.Valid {
+			d.Max = &max.Float64
+		}
+		d.Updated = time.Unix(updatedUnix, 0)
+		data = append(data, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during perfdata rows iteration: %w", err)
+	}
+
+	return data, nil
+}
+
 // GetAllHosts retrieves all hosts from the database.
 func (m *Manager) GetAllHosts() ([]Host, error) {
 	query := `SELECT hostname, last_seen FROM hosts ORDER BY hostname;`
@@ -214,6 +418,57 @@ func (m *Manager) DeleteStaleServices(threshold time.Time) (int64, error) {
 	return rowsAffected, nil
 }
 
+// DeleteStalePerfData removes performance data that has not been updated since the threshold.
+func (m *Manager) DeleteStalePerfData(threshold time.Time) (int64, error) {
+	query := `DELETE FROM perfdata WHERE updated < ?;`
+	result, err := m.db.Exec(query, threshold.Unix())
+	if err != nil {
+		logger.Logf(logger.LevelInfo, "Error executing delete stale perfdata query: %v", err)
+		return 0, fmt.Errorf("failed to execute delete stale perfdata query: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "Could not get rows affected after deleting stale perfdata: %v", err)
+		return 0, nil
+	}
+	if rowsAffected > 0 {
+		logger.Logf(logger.LevelDebug, "Deleted %d stale perfdata values (older than %s)", rowsAffected, threshold.Format(time.RFC3339))
+	}
+	return rowsAffected, nil
+}
+
+// DeleteStaleCheckStates removes check states that have not been updated since the threshold.
+func (m *Manager) DeleteStaleCheckStates(threshold time.Time) (int64, error) {
+	query := `DELETE FROM check_states WHERE last_seen < ?;`
+	result, err := m.db.Exec(query, threshold.Unix())
+	if err != nil {
+		logger.Logf(logger.LevelInfo, "Error executing delete stale check states query: %v", err)
+		return 0, fmt.Errorf("failed to execute delete stale check states query: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logger.Logf(logger.LevelDebug, "Could not get rows affected after deleting stale check states: %v", err)
+		return 0, nil
+	}
+	if rowsAffected > 0 {
+		logger.Logf(logger.LevelDebug, "Deleted %d stale check states (older than %s)", rowsAffected, threshold.Format(time.RFC3339))
+	}
+	return rowsAffected, nil
+}
+
+// Ping verifies that the database can still be reached.
+func (m *Manager) Ping(ctx context.Context) error {
+	if err := m.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+	// A trivial query also catches a database file that was removed or corrupted underneath us
+	var one int
+	if err := m.db.QueryRowContext(ctx, `SELECT 1 FROM hosts LIMIT 1;`).Scan(&one); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query database: %w", err)
+	}
+	return nil
+}
+
 // Close closes the database connection.
 func (m *Manager) Close() error {
 	if m.db != nil {
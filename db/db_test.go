@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	m, err := NewManager(filepath.Join(t.TempDir(), "data", "status.db"))
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestApplyUpdates(t *testing.T) {
+	m := newTestManager(t)
+	first := time.Unix(1700000000, 0)
+	later := first.Add(time.Minute)
+	max := 100.0
+
+	err := m.ApplyUpdates([]Update{
+		{Hostname: "web1", State: 0, Time: first},
+		{Hostname: "web1", ServiceDescription: "disk", State: 1, Time: first, PerfData: []PerfData{
+			{Label: "used", Value: 80, UOM: "%", Warn: "75", Crit: "90", Max: &max},
+			{Label: "inodes", Value: 10},
+		}},
+		// Later result for the same service in the same batch
+		{Hostname: "web1", ServiceDescription: "disk", State: 2, Time: later, PerfData: []PerfData{
+			{Label: "used", Value: 95, UOM: "%"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyUpdates: %v", err)
+	}
+
+	hosts, err := m.GetAllHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "web1" || !hosts[0].LastSeen.Equal(later) {
+		t.Errorf("hosts = %+v, want web1 last seen %v", hosts, later)
+	}
+
+	services, err := m.GetAllServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].ServiceDescription != "disk" || !services[0].LastSeen.Equal(later) {
+		t.Errorf("services = %+v, want disk on web1 last seen %v", services, later)
+	}
+
+	states, err := m.GetAllCheckStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CheckState{
+		{Hostname: "web1", ServiceDescription: "", State: 0, LastSeen: first},
+		{Hostname: "web1", ServiceDescription: "disk", State: 2, LastSeen: later},
+	}
+	if len(states) != len(want) {
+		t.Fatalf("check states = %+v, want %+v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("check state %d = %+v, want %+v", i, states[i], want[i])
+		}
+	}
+
+	perf, err := m.GetAllPerfData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The later result replaces the earlier one, so the inodes label it no longer reports is gone
+	if len(perf) != 1 {
+		t.Fatalf("perfdata = %+v, want only the later used value", perf)
+	}
+	if d := perf[0]; d.Label != "used" || d.Value != 95 || d.UOM != "%" || d.Warn != "" || d.Max != nil || !d.Updated.Equal(later) {
+		t.Errorf("perfdata = %+v", d)
+	}
+}
+
+func TestApplyUpdatesKeepsMinMax(t *testing.T) {
+	m := newTestManager(t)
+	min, max := 0.0, 1.5
+	err := m.ApplyUpdates([]Update{{Hostname: "db1", ServiceDescription: "load", Time: time.Unix(1700000000, 0), PerfData: []PerfData{
+		{Label: "load1", Value: 0.5, Min: &min, Max: &max},
+	}}})
+	if err != nil {
+		t.Fatalf("ApplyUpdates: %v", err)
+	}
+	perf, err := m.GetAllPerfData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perf) != 1 || perf[0].Min == nil || *perf[0].Min != 0 || perf[0].Max == nil || *perf[0].Max != 1.5 {
+		t.Errorf("perfdata = %+v, want min 0 and max 1.5", perf)
+	}
+}
+
+func TestDeleteStale(t *testing.T) {
+	m := newTestManager(t)
+	old := time.Unix(1700000000, 0)
+	recent := old.Add(time.Hour)
+	err := m.ApplyUpdates([]Update{
+		{Hostname: "gone", ServiceDescription: "ping", Time: old, PerfData: []PerfData{{Label: "rta", Value: 1}}},
+		{Hostname: "here", ServiceDescription: "ping", Time: recent, PerfData: []PerfData{{Label: "rta", Value: 2}}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyUpdates: %v", err)
+	}
+
+	threshold := old.Add(time.Minute)
+	deletes := []struct {
+		name   string
+		delete func(time.Time) (int64, error)
+	}{
+		{"hosts", m.DeleteStaleHosts},
+		{"services", m.DeleteStaleServices},
+		{"perfdata", m.DeleteStalePerfData},
+		{"check states", m.DeleteStaleCheckStates},
+	}
+	for _, d := range deletes {
+		n, err := d.delete(threshold)
+		if err != nil || n != 1 {
+			t.Errorf("deleting stale %s = %d, %v, want 1", d.name, n, err)
+		}
+		// Nothing left to delete the second time
+		if n, err := d.delete(threshold); err != nil || n != 0 {
+			t.Errorf("deleting stale %s again = %d, %v, want 0", d.name, n, err)
+		}
+	}
+
+	hosts, _ := m.GetAllHosts()
+	services, _ := m.GetAllServices()
+	states, _ := m.GetAllCheckStates()
+	perf, _ := m.GetAllPerfData()
+	if len(hosts) != 1 || hosts[0].Hostname != "here" ||
+		len(services) != 1 || services[0].Hostname != "here" ||
+		len(states) != 1 || states[0].Hostname != "here" ||
+		len(perf) != 1 || perf[0].Hostname != "here" {
+		t.Errorf("after deleting stale rows: hosts %+v services %+v states %+v perfdata %+v", hosts, services, states, perf)
+	}
+}
+
+func TestPing(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping on an empty database: %v", err)
+	}
+	m.Close()
+	if err := m.Ping(context.Background()); err == nil {
+		t.Error("Ping succeeded on a closed database")
+	}
+}
+
+func TestNewManagerUsesWAL(t *testing.T) {
+	m := newTestManager(t)
+	var mode string
+	if err := m.db.QueryRow(`PRAGMA journal_mode;`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal mode = %q, want wal", mode)
+	}
+}
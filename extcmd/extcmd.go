@@ -0,0 +1,195 @@
+package extcmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"nrdp_micro/logger"
+)
+
+// pipeBuf is the largest write that is atomic on a Linux pipe. Commands are written
+// in chunks no larger than this so they are never interleaved with other writers.
+const pipeBuf = 4096
+
+// MaxCommandLength is the longest command accepted, leaving room for the timestamp prefix
+const MaxCommandLength = pipeBuf - 24
+
+// ErrInvalidCommand is returned for commands that cannot be written safely
+var ErrInvalidCommand = errors.New("invalid external command")
+
+// Writer writes external commands to the Nagios command file.
+// The command file is normally a FIFO read by Nagios; a regular file may be used as a stand-in.
+// The file is kept open between writes and reopened when a write fails or Nagios
+// recreates the pipe on restart.
+type Writer struct {
+	path    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	info os.FileInfo // identity of the open file, used to detect a recreated pipe
+}
+
+// NewWriter creates a new writer for the given command file path.
+// Writes that cannot complete within timeout fail instead of blocking forever.
+func NewWriter(path string, timeout time.Duration) *Writer {
+	return &Writer{path: path, timeout: timeout}
+}
+
+// Path returns the command file path
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// Submit writes a single external command, prefixed with the current timestamp.
+func (w *Writer) Submit(command string) error {
+	return w.SubmitAt(time.Now(), command)
+}
+
+// SubmitAt writes a single external command with the given timestamp.
+func (w *Writer) SubmitAt(ts time.Time, command string) error {
+	line, err := formatLine(ts, command)
+	if err != nil {
+		return err
+	}
+	return w.write([]string{line})
+}
+
+// SubmitAll writes several commands sharing the same timestamp.
+func (w *Writer) SubmitAll(ts time.Time, commands []string) error {
+	lines := make([]string, 0, len(commands))
+	for _, command := range commands {
+		line, err := formatLine(ts, command)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	return w.write(lines)
+}
+
+// Close closes the command file if it is open
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeLocked()
+}
+
+// formatLine validates a command and formats it as a command file line.
+// The command must not contain line breaks, as these would allow injecting
+// additional commands into the Nagios command pipe.
+func formatLine(ts time.Time, command string) (string, error) {
+	command = strings.TrimSpace(command)
+	if command == "" || strings.ContainsAny(command, "\r\n") {
+		return "", ErrInvalidCommand
+	}
+	if len(command) > MaxCommandLength {
+		return "", fmt.Errorf("%w: command exceeds %d bytes", ErrInvalidCommand, MaxCommandLength)
+	}
+	return fmt.Sprintf("[%d] %s\n", ts.Unix(), command), nil
+}
+
+func (w *Writer) write(lines []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, chunk := range chunkLines(lines) {
+		// Retry once on a fresh descriptor, which covers Nagios having restarted
+		// and recreated the pipe since the last write.
+		err := w.writeChunk(chunk)
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "extcmd: write to %s failed, reopening: %v", w.path, err)
+			w.closeLocked()
+			err = w.writeChunk(chunk)
+		}
+		if err != nil {
+			w.closeLocked()
+			return err
+		}
+	}
+
+	logger.Logf(logger.LevelTrace, "extcmd: wrote %d commands to %s", len(lines), w.path)
+	return nil
+}
+
+func (w *Writer) writeChunk(chunk string) error {
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+
+	if w.timeout > 0 {
+		// Regular files do not support deadlines; writes to them never block anyway
+		if err := w.file.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+			return fmt.Errorf("failed to set write deadline on %s: %v", w.path, err)
+		}
+	}
+
+	if _, err := w.file.WriteString(chunk); err != nil {
+		return fmt.Errorf("failed to write to command file %s: %v", w.path, err)
+	}
+	return nil
+}
+
+// openLocked opens the command file unless the open descriptor still refers to it.
+func (w *Writer) openLocked() error {
+	if w.file != nil {
+		current, err := os.Stat(w.path)
+		if err == nil && os.SameFile(current, w.info) {
+			return nil
+		}
+		logger.Logf(logger.LevelInfo, "extcmd: command file %s was replaced, reopening", w.path)
+		w.closeLocked()
+	}
+
+	// Open non-blocking so a missing reader (Nagios not running) fails immediately
+	// instead of hanging the caller.
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			return fmt.Errorf("command file %s has no reader (is Nagios running?)", w.path)
+		}
+		return fmt.Errorf("failed to open command file %s: %v", w.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat command file %s: %v", w.path, err)
+	}
+
+	w.file = f
+	w.info = info
+	logger.Logf(logger.LevelDebug, "extcmd: opened command file %s", w.path)
+	return nil
+}
+
+func (w *Writer) closeLocked() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.info = nil
+	return err
+}
+
+// chunkLines groups lines into chunks of at most pipeBuf bytes without splitting a line.
+func chunkLines(lines []string) []string {
+	var chunks []string
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+len(line) > pipeBuf {
+			chunks = append(chunks, b.String())
+			b.Reset()
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
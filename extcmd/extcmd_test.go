@@ -0,0 +1,123 @@
+package extcmd
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var ts = time.Unix(1700000000, 0)
+
+func TestFormatLineRejectsInjection(t *testing.T) {
+	for _, command := range []string{"", "  ", "A;b\nPROCESS_HOST_CHECK_RESULT;x;0;ok", "A\rB", strings.Repeat("x", MaxCommandLength+1)} {
+		if _, err := formatLine(ts, command); !errors.Is(err, ErrInvalidCommand) {
+			t.Errorf("formatLine(%q) = %v, want ErrInvalidCommand", command, err)
+		}
+	}
+	line, err := formatLine(ts, " DISABLE_NOTIFICATIONS ")
+	if err != nil || line != "[1700000000] DISABLE_NOTIFICATIONS\n" {
+		t.Errorf("formatLine = %q, %v", line, err)
+	}
+}
+
+func TestChunkLinesKeepsLinesWhole(t *testing.T) {
+	line := strings.Repeat("x", 1000) + "\n"
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = line
+	}
+	chunks := chunkLines(lines)
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > pipeBuf || len(chunk)%len(line) != 0 {
+			t.Errorf("chunk %d is %d bytes", i, len(chunk))
+		}
+	}
+}
+
+// newFIFO creates a named pipe and opens it for reading, as Nagios does
+func newFIFO(t *testing.T, path string) *bufio.Reader {
+	t.Helper()
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	// Non-blocking so opening does not wait for a writer
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return bufio.NewReader(f)
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			return line
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no line from the pipe: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriterFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nagios.cmd")
+
+	w := NewWriter(path, time.Second)
+	defer w.Close()
+	if err := w.SubmitAt(ts, "DISABLE_NOTIFICATIONS"); err == nil {
+		t.Fatal("write to a missing command file succeeded")
+	}
+
+	r := newFIFO(t, path)
+	if err := w.SubmitAt(ts, "DISABLE_NOTIFICATIONS"); err != nil {
+		t.Fatalf("SubmitAt: %v", err)
+	}
+	if got := readLine(t, r); got != "[1700000000] DISABLE_NOTIFICATIONS\n" {
+		t.Errorf("read %q", got)
+	}
+
+	// Nagios recreates the pipe when it restarts
+	os.Remove(path)
+	r = newFIFO(t, path)
+	if err := w.SubmitAll(ts, []string{"A", "B"}); err != nil {
+		t.Fatalf("SubmitAll after the pipe was recreated: %v", err)
+	}
+	for _, want := range []string{"[1700000000] A\n", "[1700000000] B\n"} {
+		if got := readLine(t, r); got != want {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWriterNoReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nagios.cmd")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	w := NewWriter(path, time.Second)
+	defer w.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- w.Submit("DISABLE_NOTIFICATIONS") }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no reader") {
+			t.Errorf("Submit without a reader = %v, want a no reader error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submit blocked on a pipe without a reader")
+	}
+}
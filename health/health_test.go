@@ -0,0 +1,61 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(t *testing.T, h http.Handler) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, report
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := NewChecker()
+	c.Add("database", func(ctx context.Context) error { return nil })
+	c.Add("spool", func(ctx context.Context) error { return nil })
+
+	code, report := serve(t, c.ReadyHandler())
+	if code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 2 {
+		t.Fatalf("ready = %d %+v, want 200 with two passing checks", code, report)
+	}
+
+	c.Add("spool", func(ctx context.Context) error { return errors.New("spool directory is full") })
+	code, report = serve(t, c.ReadyHandler())
+	if code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Fatalf("ready = %d %+v, want 503", code, report)
+	}
+	if got := report.Checks["spool"]; got.Status != "fail" || got.Error != "spool directory is full" {
+		t.Errorf("spool check = %+v", got)
+	}
+	if got := report.Checks["database"]; got.Status != "ok" {
+		t.Errorf("database check = %+v", got)
+	}
+	if len(report.Checks) != 2 {
+		t.Errorf("%d checks after replacing one, want 2", len(report.Checks))
+	}
+}
+
+func TestReadyHandlerNoChecks(t *testing.T) {
+	if code, report := serve(t, NewChecker().ReadyHandler()); code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("ready without checks = %d %+v, want 200", code, report)
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	LiveHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("live = %d %v", rec.Code, rec.Header())
+	}
+}
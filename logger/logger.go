@@ -15,13 +15,33 @@ const (
 	LevelTrace
 )
 
+// Printer receives the formatted log lines; *log.Logger implements it
+type Printer interface {
+	Printf(format string, v ...interface{})
+}
+
+var _ Printer = (*log.Logger)(nil)
+
 var (
 	currentLevel Level
-	logger       *log.Logger
+	logger       Printer
 )
 
-// Configure sets up the logger with the specified level
-func Configure(l Level, lg *log.Logger) {
+// ParseLevel converts a configured level name to a Level, defaulting to LevelInfo
+func ParseLevel(name string) Level {
+	switch name {
+	case "debug":
+		return LevelDebug
+	case "trace":
+		return LevelTrace
+	default:
+		return LevelInfo
+	}
+}
+
+// Configure sets up the logger with the specified level. The logger is shared by
+// the whole process.
+func Configure(l Level, lg Printer) {
 	currentLevel = l
 	logger = lg
 }
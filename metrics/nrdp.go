@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"nrdp_micro/db"
+	"nrdp_micro/logger"
+	"nrdp_micro/storage"
+)
+
+// Service metrics updated by the HTTP handler, the config generator and the reload watcher
+var (
+	RequestsTotal = NewCounterVec("nrdp_requests_total",
+		"HTTP requests handled, by response status code.", "code")
+	ResultsAcceptedTotal = NewCounterVec("nrdp_results_accepted_total",
+		"Check results accepted for delivery, by result type and state.", "type", "state")
+	ResultsRejectedTotal = NewCounterVec("nrdp_results_rejected_total",
+		"Check results rejected by validation or delivery.")
+	ParseFailuresTotal = NewCounterVec("nrdp_parse_failures_total",
+		"Submissions whose XMLDATA or JSONDATA could not be parsed, by format.", "format")
+	DBWriteSeconds = NewHistogramVec("nrdp_db_write_duration_seconds",
+		"Latency of database writes made while handling submissions, by operation.", DefaultBuckets, "op")
+	ConfigGenerationSeconds = NewHistogramVec("nrdp_config_generation_duration_seconds",
+		"Duration of Nagios config generation cycles.", DefaultBuckets)
+	ReloadsTotal = NewCounterVec("nrdp_nagios_reloads_total",
+		"Nagios reload command executions, by outcome.", "outcome")
+	DeniedTotal = NewCounterVec("nrdp_denied_requests_total",
+		"Requests refused by the source address allow/deny lists.")
+	ThrottledTotal = NewCounterVec("nrdp_throttled_requests_total",
+		"Requests refused by a rate limit, by limit (requests or results) and key (ip or token).", "limit", "by")
+)
+
+// DefaultRegistry holds the service metrics and process metrics
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.Register(
+		RequestsTotal,
+		ResultsAcceptedTotal,
+		ResultsRejectedTotal,
+		ParseFailuresTotal,
+		DBWriteSeconds,
+		ConfigGenerationSeconds,
+		ReloadsTotal,
+		DeniedTotal,
+		ThrottledTotal,
+		CollectorFunc(collectProcess),
+	)
+}
+
+// collectProcess writes the goroutine, file descriptor and memory figures from GetMetrics
+func collectProcess(w io.Writer) {
+	m := GetMetrics()
+	WriteGauge(w, "nrdp_goroutines", "Number of goroutines.", float64(m.Goroutines))
+	WriteGauge(w, "nrdp_open_fds", "Number of open file descriptors.", float64(m.OpenFiles))
+	WriteGauge(w, "nrdp_tcp_connections", "Number of entries in /proc/net/tcp.", float64(m.TCPConnections))
+	WriteGauge(w, "nrdp_memory_alloc_bytes", "Bytes of allocated heap objects.", float64(m.MemStats.Alloc))
+	WriteGauge(w, "nrdp_memory_sys_bytes", "Bytes of memory obtained from the OS.", float64(m.MemStats.Sys))
+	WriteGauge(w, "nrdp_memory_heap_objects", "Number of allocated heap objects.", float64(m.MemStats.HeapObjects))
+	WriteHeader(w, "nrdp_gc_cycles_total", "Completed garbage collection cycles.", "counter")
+	WriteSample(w, "nrdp_gc_cycles_total", nil, float64(m.MemStats.NumGC))
+}
+
+// NewStorageCollector exposes the spool directory statistics from storage.Manager.GetStats
+func NewStorageCollector(m *storage.Manager) Collector {
+	return CollectorFunc(func(w io.Writer) {
+		stats, err := m.GetStats()
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "metrics: failed to get storage stats: %v", err)
+			return
+		}
+		if count, ok := stats["file_count"].(int); ok {
+			WriteGauge(w, "nrdp_spool_files", "Regular files in the spool directory.", float64(count))
+		}
+		if max, ok := stats["max_files"].(int); ok {
+			WriteGauge(w, "nrdp_spool_max_files", "Spool file count at which submissions are refused.", float64(max))
+		}
+		if free, ok := stats["free_space_percent"].(float64); ok {
+			WriteGauge(w, "nrdp_spool_free_space_percent", "Free space on the spool filesystem in percent.", free)
+		}
+		if free, ok := stats["free_space_bytes"].(float64); ok {
+			WriteGauge(w, "nrdp_spool_free_space_bytes", "Free space on the spool filesystem in bytes.", free)
+		}
+	})
+}
+
+// CountRequests wraps an HTTP handler, counting its responses in RequestsTotal by status code
+func CountRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		RequestsTotal.Inc(strconv.Itoa(rec.code))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.code = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// CheckStateStore is the part of db.Manager read by the check state collector
+type CheckStateStore interface {
+	GetAllCheckStates() ([]db.CheckState, error)
+	GetAllPerfData() ([]db.PerfData, error)
+}
+
+// NewCheckStateCollector exposes the latest state, last seen time and performance data of
+// every host and service in the store. Host check results have an empty service label.
+// Hostnames come from clients, so at most maxSeries samples are written per metric and
+// nrdp_check_series_omitted reports how many were left out.
+func NewCheckStateCollector(store CheckStateStore, maxSeries int) Collector {
+	return CollectorFunc(func(w io.Writer) {
+		var omittedStates, omittedPerfData int
+		states, err := store.GetAllCheckStates()
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "metrics: failed to get check states: %v", err)
+		} else {
+			if len(states) > maxSeries {
+				omittedStates = len(states) - maxSeries
+				states = states[:maxSeries]
+			}
+			WriteHeader(w, "nrdp_check_state", "Latest check state (0 OK/UP, 1 WARNING/DOWN, 2 CRITICAL/UNREACHABLE, 3 UNKNOWN).", "gauge")
+			for _, s := range states {
+				WriteSample(w, "nrdp_check_state", []Label{{"host", s.Hostname}, {"service", s.ServiceDescription}}, float64(s.State))
+			}
+			WriteHeader(w, "nrdp_check_last_seen_seconds", "Unix time the latest check result was received.", "gauge")
+			for _, s := range states {
+				WriteSample(w, "nrdp_check_last_seen_seconds", []Label{{"host", s.Hostname}, {"service", s.ServiceDescription}}, float64(s.LastSeen.Unix()))
+			}
+		}
+
+		perfData, err := store.GetAllPerfData()
+		if err != nil {
+			logger.Logf(logger.LevelDebug, "metrics: failed to get perfdata: %v", err)
+		} else {
+			if len(perfData) > maxSeries {
+				omittedPerfData = len(perfData) - maxSeries
+				perfData = perfData[:maxSeries]
+			}
+			WriteHeader(w, "nrdp_perfdata", "Latest performance data value reported by the plugin.", "gauge")
+			for _, p := range perfData {
+				labels := []Label{{"host", p.Hostname}, {"service", p.ServiceDescription}, {"label", p.Label}, {"uom", p.UOM}}
+				WriteSample(w, "nrdp_perfdata", labels, p.Value)
+			}
+		}
+
+		if omittedStates > 0 || omittedPerfData > 0 {
+			logger.Logf(logger.LevelDebug, "metrics: omitted %d check states and %d perfdata values over the limit of %d series", omittedStates, omittedPerfData, maxSeries)
+		}
+		WriteHeader(w, "nrdp_check_series_omitted", "Check states or perfdata values left out of the metrics because of metrics_max_series.", "gauge")
+		WriteSample(w, "nrdp_check_series_omitted", []Label{{"metric", "nrdp_check_state"}}, float64(omittedStates))
+		WriteSample(w, "nrdp_check_series_omitted", []Label{{"metric", "nrdp_perfdata"}}, float64(omittedPerfData))
+	})
+}
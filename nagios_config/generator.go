@@ -9,24 +9,33 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"nrdp_micro/config"
 	"nrdp_micro/db"
 	"nrdp_micro/logger"
+	"nrdp_micro/metrics"
 )
 
 // Generator handles the generation of Nagios config files.
 type Generator struct {
 	config         *config.NagiosConfig
-	db             *db.Manager
+	db             db.Store
+	now            func() time.Time
 	interval       time.Duration
 	staleThreshold time.Duration
 	ReloadChan     chan struct{} // Channel to signal config reload
+
+	mu          sync.Mutex
+	lastSuccess time.Time // End of the last generation cycle that completed without errors
+
+	stop chan struct{}
+	done chan struct{}
 }
 
 // NewGenerator creates a new Nagios config generator.
-func NewGenerator(cfg *config.NagiosConfig, dbManager *db.Manager) (*Generator, error) {
+func NewGenerator(cfg *config.NagiosConfig, dbManager db.Store) (*Generator, error) {
 	interval, err := time.ParseDuration(cfg.GenerationInterval)
 	if err != nil {
 		return nil, fmt.Errorf("invalid generation interval: %w", err)
@@ -39,31 +48,86 @@ func NewGenerator(cfg *config.NagiosConfig, dbManager *db.Manager) (*Generator,
 	return &Generator{
 		config:         cfg,
 		db:             dbManager,
+		now:            time.Now,
 		interval:       interval,
 		staleThreshold: staleThreshold,
 		ReloadChan:     make(chan struct{}), // Initialize the channel
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
 	}, nil
 }
 
+// SetClock replaces the time source used for stale cutoffs and the health check.
+// It must be called before Start.
+func (g *Generator) SetClock(now func() time.Time) {
+	g.now = now
+}
+
 // Start runs the generator periodically in a goroutine.
 func (g *Generator) Start() {
 	logger.Logf(logger.LevelInfo, "Starting Nagios config generator (interval: %s, stale after: %s, output: %s)", g.interval, g.staleThreshold, g.config.OutputDir)
 	ticker := time.NewTicker(g.interval)
 	go func() {
+		defer close(g.done)
+		defer ticker.Stop()
 		// Generate once immediately on start
 		g.generateConfigs()
-		for range ticker.C {
-			g.generateConfigs()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+				g.generateConfigs()
+			}
 		}
 	}()
 }
 
+// Stop stops the generator after the cycle in progress, if any, and closes ReloadChan
+// so the reload watcher exits. It must only be called after Start.
+func (g *Generator) Stop() {
+	close(g.stop)
+	<-g.done
+	close(g.ReloadChan)
+	logger.Logf(logger.LevelDebug, "Nagios config generator stopped")
+}
+
+// LastSuccess returns when the last generation cycle completed without errors, zero if none has
+func (g *Generator) LastSuccess() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lastSuccess
+}
+
+// CheckHealth reports an error when no generation cycle has succeeded within the last
+// three intervals, so a single slow or failed cycle does not mark the service unready.
+func (g *Generator) CheckHealth() error {
+	last := g.LastSuccess()
+	if last.IsZero() {
+		return errors.New("no successful config generation yet")
+	}
+	if age := g.now().Sub(last); age > 3*g.interval {
+		return fmt.Errorf("last successful config generation was %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+func (g *Generator) markSuccess() {
+	g.mu.Lock()
+	g.lastSuccess = g.now()
+	g.mu.Unlock()
+}
+
 // generateConfigs fetches data from DB and writes Nagios config files.
 func (g *Generator) generateConfigs() {
 	logger.Logf(logger.LevelDebug, "Running Nagios config generation cycle...")
+	start := time.Now()
+	defer func() {
+		metrics.ConfigGenerationSeconds.Observe(time.Since(start).Seconds())
+	}()
 
 	// 1. Delete stale entries from DB
-	staleCutoff := time.Now().Add(-g.staleThreshold)
+	staleCutoff := g.now().Add(-g.staleThreshold)
 	deletedHosts, err := g.db.DeleteStaleHosts(staleCutoff)
 	if err != nil {
 		logger.Logf(logger.LevelInfo, "Error deleting stale hosts: %v", err)
@@ -74,6 +138,12 @@ func (g *Generator) generateConfigs() {
 		logger.Logf(logger.LevelInfo, "Error deleting stale services: %v", err)
 		// Don't necessarily stop, generating with remaining data might be okay
 	}
+	if _, err := g.db.DeleteStalePerfData(staleCutoff); err != nil {
+		logger.Logf(logger.LevelInfo, "Error deleting stale perfdata: %v", err)
+	}
+	if _, err := g.db.DeleteStaleCheckStates(staleCutoff); err != nil {
+		logger.Logf(logger.LevelInfo, "Error deleting stale check states: %v", err)
+	}
 	if deletedHosts > 0 || deletedServices > 0 {
 		logger.Logf(logger.LevelInfo, "Pruned %d stale hosts and %d stale services older than %s", deletedHosts, deletedServices, staleCutoff.Format(time.RFC3339))
 	}
@@ -95,6 +165,7 @@ func (g *Generator) generateConfigs() {
 		logger.Logf(logger.LevelDebug, "No active hosts or services found in DB, skipping config generation.")
 		// Optionally: write an empty config file or delete the existing one?
 		// For now, just skip generation.
+		g.markSuccess()
 		return
 	}
 
@@ -161,6 +232,7 @@ func (g *Generator) generateConfigs() {
 	// Compare new content with existing content
 	if bytes.Equal(newConfigContent, existingConfigContent) {
 		logger.Logf(logger.LevelDebug, "Generated Nagios config is identical to the existing one (%s). Skipping write and reload signal.", finalFileName)
+		g.markSuccess()
 		return // No change, do nothing further
 	}
 
@@ -183,6 +255,7 @@ func (g *Generator) generateConfigs() {
 	}
 
 	logger.Logf(logger.LevelInfo, "Successfully generated and updated Nagios config: %s (%d hosts, %d services)", finalFileName, len(hosts), len(services))
+	g.markSuccess()
 
 	// Signal that the config has been updated
 	// Use non-blocking send in case no one is listening (though main should be)
@@ -0,0 +1,132 @@
+package nrdp
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Status values used in NRDP response documents
+const (
+	StatusOK    = 0
+	StatusError = -1
+)
+
+// Format is the encoding of a response document
+type Format int
+
+const (
+	FormatXML Format = iota
+	FormatJSON
+)
+
+// Response is the NRDP response document returned to clients
+type Response struct {
+	XMLName xml.Name `xml:"result" json:"-"`
+	Status  int      `xml:"status" json:"status"`
+	Message string   `xml:"message" json:"message"`
+	Product string   `xml:"product,omitempty" json:"product,omitempty"`
+	Version string   `xml:"version,omitempty" json:"version,omitempty"`
+	Meta    *Meta    `xml:"meta,omitempty" json:"meta,omitempty"`
+}
+
+// Meta carries the processing summary of a submission
+type Meta struct {
+	Output   string      `xml:"output" json:"output"`
+	Accepted int         `xml:"accepted" json:"accepted"`
+	Rejected []Rejection `xml:"rejected>checkresult,omitempty" json:"rejected,omitempty"`
+}
+
+// Rejection describes a single check result that was not accepted
+type Rejection struct {
+	Index       int    `xml:"index,attr" json:"index"`
+	HostName    string `xml:"hostname" json:"hostname"`
+	ServiceName string `xml:"servicename,omitempty" json:"servicename,omitempty"`
+	Reason      string `xml:"reason" json:"reason"`
+}
+
+// jsonEnvelope wraps the response the way upstream NRDP encodes JSON output
+type jsonEnvelope struct {
+	Result *Response `json:"result"`
+}
+
+// OK returns a successful response with the given message
+func OK(message string) Response {
+	return Response{Status: StatusOK, Message: message}
+}
+
+// Error returns an error response with the given message
+func Error(message string) Response {
+	return Response{Status: StatusError, Message: message}
+}
+
+// RequestFormat determines the response format requested by the client.
+// JSON is used when the client asks for it with format=json or an Accept header,
+// or when it submitted JSONDATA. Form values must already be parsed.
+func RequestFormat(r *http.Request) Format {
+	switch strings.ToLower(r.FormValue("format")) {
+	case "json":
+		return FormatJSON
+	case "xml":
+		return FormatXML
+	}
+	if r.FormValue("JSONDATA") != "" {
+		return FormatJSON
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return FormatJSON
+	}
+	return FormatXML
+}
+
+// Encode serializes the response in the given format
+func (resp Response) Encode(format Format) ([]byte, string, error) {
+	if format == FormatJSON {
+		body, err := json.Marshal(jsonEnvelope{Result: &resp})
+		if err != nil {
+			return nil, "", err
+		}
+		return append(body, '\n'), "application/json; charset=utf-8", nil
+	}
+
+	body, err := xml.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(xml.Header + string(body) + "\n"), "application/xml; charset=utf-8", nil
+}
+
+// Decode parses a response document in either format, as returned by Encode or by
+// upstream NRDP. JSON documents are recognized by their leading brace.
+func Decode(body []byte) (Response, error) {
+	var resp Response
+	trimmed := bytes.TrimSpace(body)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var env jsonEnvelope
+		env.Result = &resp
+		if err := json.Unmarshal(trimmed, &env); err != nil {
+			return Response{}, fmt.Errorf("invalid JSON response: %v", err)
+		}
+		return resp, nil
+	}
+	if err := xml.Unmarshal(trimmed, &resp); err != nil {
+		return Response{}, fmt.Errorf("invalid XML response: %v", err)
+	}
+	return resp, nil
+}
+
+// Write encodes the response and writes it with the given HTTP status code
+func Write(w http.ResponseWriter, code int, format Format, resp Response) {
+	body, contentType, err := resp.Encode(format)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(code)
+	w.Write(body)
+}
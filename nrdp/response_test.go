@@ -0,0 +1,98 @@
+package nrdp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResponseRoundTrip(t *testing.T) {
+	resp := OK("PARTIAL")
+	resp.Meta = &Meta{
+		Output:   "1 checks processed, 1 rejected.",
+		Accepted: 1,
+		Rejected: []Rejection{{Index: 1, HostName: "web01", ServiceName: "HTTP", Reason: "unknown host"}},
+	}
+	for _, format := range []Format{FormatXML, FormatJSON} {
+		body, contentType, err := resp.Encode(format)
+		if err != nil {
+			t.Fatalf("Encode(%d): %v", format, err)
+		}
+		wantType := "application/xml; charset=utf-8"
+		if format == FormatJSON {
+			wantType = "application/json; charset=utf-8"
+		}
+		if contentType != wantType {
+			t.Errorf("Encode(%d) content type = %q, want %q", format, contentType, wantType)
+		}
+		got, err := Decode(body)
+		if err != nil {
+			t.Fatalf("Decode(%s): %v", body, err)
+		}
+		got.XMLName = resp.XMLName
+		if !reflect.DeepEqual(got, resp) {
+			t.Errorf("round trip of format %d = %+v, want %+v", format, got, resp)
+		}
+	}
+}
+
+func TestDecodeUpstreamDocuments(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Response
+	}{
+		{"xml", `<?xml version="1.0"?><result><status>0</status><message>OK</message><meta><output>1 checks processed.</output></meta></result>`,
+			Response{Status: StatusOK, Message: "OK", Meta: &Meta{Output: "1 checks processed."}}},
+		{"json", `{"result": {"status": -1, "message": "BAD TOKEN SUPPLIED"}}`,
+			Response{Status: StatusError, Message: "BAD TOKEN SUPPLIED"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			got.XMLName = tt.want.XMLName
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := Decode([]byte("not a document")); err == nil {
+		t.Error("Decode accepted garbage")
+	}
+}
+
+func TestRequestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		accept string
+		want   Format
+	}{
+		{"default", url.Values{}, "", FormatXML},
+		{"format json", url.Values{"format": {"JSON"}}, "", FormatJSON},
+		{"jsondata", url.Values{"JSONDATA": {"{}"}}, "", FormatJSON},
+		{"format overrides jsondata", url.Values{"JSONDATA": {"{}"}, "format": {"xml"}}, "", FormatXML},
+		{"accept header", url.Values{}, "application/json", FormatJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			if got := RequestFormat(r); got != tt.want {
+				t.Errorf("RequestFormat = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
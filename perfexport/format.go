@@ -0,0 +1,116 @@
+package perfexport
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"nrdp_micro/check"
+)
+
+// hostServiceName is used in place of the service for host check results, as pnp4nagios does
+const hostServiceName = "_HOST_"
+
+// formatResult renders the performance data of a result as Graphite plaintext or
+// InfluxDB line protocol lines, without trailing newlines.
+func formatResult(format, prefix string, result *check.Result, now time.Time) []string {
+	output := result.PluginOutput()
+	if len(output.PerfData) == 0 {
+		return nil
+	}
+
+	ts := now
+	if result.Time > 0 {
+		ts = time.Unix(result.Time, 0)
+	}
+	service := result.ServiceName
+	if result.IsHost() {
+		service = hostServiceName
+	}
+
+	lines := make([]string, 0, len(output.PerfData))
+	for _, p := range output.PerfData {
+		if !finite(p.Value) {
+			continue // Neither format can carry Inf or NaN
+		}
+		if format == FormatInflux {
+			lines = append(lines, influxLine(prefix, result.HostName, service, p, ts))
+		} else {
+			lines = append(lines, graphiteLine(prefix, result.HostName, service, p, ts))
+		}
+	}
+	return lines
+}
+
+// graphiteLine renders "<prefix>.<host>.<service>.<label> <value> <timestamp>"
+func graphiteLine(prefix, host, service string, p check.PerfDatum, ts time.Time) string {
+	path := []string{graphiteSegment(host), graphiteSegment(service), graphiteSegment(p.Label)}
+	if prefix != "" {
+		path = append([]string{prefix}, path...)
+	}
+	return fmt.Sprintf("%s %s %d", strings.Join(path, "."), formatFloat(p.Value), ts.Unix())
+}
+
+// graphiteSegment replaces characters that have a meaning in Graphite metric paths
+func graphiteSegment(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// influxLine renders "<measurement>,host=..,service=..,label=..[,uom=..] value=..[,warn=..] <ns>"
+func influxLine(measurement, host, service string, p check.PerfDatum, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxEscape(measurement, false))
+	b.WriteString(",host=" + influxEscape(host, true))
+	b.WriteString(",service=" + influxEscape(service, true))
+	b.WriteString(",label=" + influxEscape(p.Label, true))
+	if p.UOM != "" {
+		b.WriteString(",uom=" + influxEscape(p.UOM, true))
+	}
+
+	b.WriteString(" value=" + formatFloat(p.Value))
+	// Thresholds are only exported when they are plain numbers rather than ranges, and
+	// fields are skipped when not finite ("inf" and "nan" parse as floats), as line
+	// protocol has no representation for them
+	if v, err := strconv.ParseFloat(p.Warn, 64); err == nil && finite(v) {
+		b.WriteString(",warn=" + formatFloat(v))
+	}
+	if v, err := strconv.ParseFloat(p.Crit, 64); err == nil && finite(v) {
+		b.WriteString(",crit=" + formatFloat(v))
+	}
+	if p.Min != nil && finite(*p.Min) {
+		b.WriteString(",min=" + formatFloat(*p.Min))
+	}
+	if p.Max != nil && finite(*p.Max) {
+		b.WriteString(",max=" + formatFloat(*p.Max))
+	}
+
+	b.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10))
+	return b.String()
+}
+
+// influxEscape escapes measurement names (commas, spaces) and tag keys/values (also equals signs)
+func influxEscape(s string, tag bool) string {
+	replacer := strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	if tag {
+		replacer = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`, "\n", `\n`)
+	}
+	return replacer.Replace(s)
+}
+
+// finite reports whether v is neither infinite nor NaN
+func finite(v float64) bool {
+	return !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,309 @@
+package perfexport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nrdp_micro/check"
+	"nrdp_micro/logger"
+)
+
+// Supported output formats
+const (
+	FormatGraphite = "graphite"
+	FormatInflux   = "influx"
+)
+
+// Supported transports
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolHTTP = "http"
+)
+
+// maxDatagramSize keeps UDP packets below a typical MTU
+const maxDatagramSize = 1400
+
+// maxErrorBody bounds how much of an HTTP error response is logged
+const maxErrorBody = 512
+
+// errRejected marks batches the endpoint refused as invalid, which resending cannot fix
+var errRejected = errors.New("rejected")
+
+// Options configures an Exporter
+type Options struct {
+	Format        string        // FormatGraphite or FormatInflux
+	Protocol      string        // ProtocolTCP, ProtocolUDP or ProtocolHTTP
+	Address       string        // host:port, or the full URL for HTTP
+	Prefix        string        // Graphite path prefix or InfluxDB measurement name
+	BatchSize     int           // Lines sent per flush
+	FlushInterval time.Duration // Longest time lines wait before being sent
+	BufferSize    int           // Lines kept while the endpoint is unreachable; oldest are dropped beyond this
+	Timeout       time.Duration // Connect and write timeout
+}
+
+// Exporter is a check.Sink that forwards performance data to Graphite or InfluxDB.
+// Export is best effort: Write only buffers lines and never fails the submission,
+// while a background goroutine sends them in batches and keeps unsent lines in a
+// bounded buffer for retry.
+type Exporter struct {
+	opts   Options
+	client *http.Client
+
+	mu      sync.Mutex
+	buffer  []string
+	dropped int64
+	conn    net.Conn
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates an exporter and starts its flush loop
+func New(opts Options) (*Exporter, error) {
+	switch opts.Format {
+	case FormatGraphite, FormatInflux:
+	default:
+		return nil, fmt.Errorf("unsupported perfdata export format: %s", opts.Format)
+	}
+	switch opts.Protocol {
+	case ProtocolTCP, ProtocolUDP, ProtocolHTTP:
+	default:
+		return nil, fmt.Errorf("unsupported perfdata export protocol: %s", opts.Protocol)
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.BufferSize < opts.BatchSize {
+		opts.BufferSize = opts.BatchSize
+	}
+
+	e := &Exporter{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+
+	logger.Logf(logger.LevelInfo, "Exporting perfdata as %s over %s to %s", opts.Format, opts.Protocol, opts.Address)
+	return e, nil
+}
+
+// Write buffers the performance data of the results for export
+func (e *Exporter) Write(ctx context.Context, results []check.Result) error {
+	now := time.Now()
+	var lines []string
+	for i := range results {
+		lines = append(lines, formatResult(e.opts.Format, e.opts.Prefix, &results[i], now)...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	e.buffer = append(e.buffer, lines...)
+	if over := len(e.buffer) - e.opts.BufferSize; over > 0 {
+		e.buffer = e.buffer[over:]
+		e.dropped += int64(over)
+		logger.Logf(logger.LevelDebug, "perfexport: buffer full, dropped %d oldest lines (%d total)", over, e.dropped)
+	}
+	full := len(e.buffer) >= e.opts.BatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close sends what is left in the buffer and stops the exporter
+func (e *Exporter) Close() error {
+	close(e.stop)
+	<-e.done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	if len(e.buffer) > 0 {
+		logger.Logf(logger.LevelInfo, "perfexport: discarding %d unsent lines on shutdown", len(e.buffer))
+	}
+	return nil
+}
+
+// Dropped returns the number of lines discarded because the buffer was full
+func (e *Exporter) Dropped() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			e.flush()
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+		e.flush()
+	}
+}
+
+// flush sends buffered lines batch by batch until the buffer is empty or a send fails.
+// A failed batch is put back at the front of the buffer and retried on the next flush,
+// unless the endpoint rejected it as invalid, in which case it is dropped.
+func (e *Exporter) flush() {
+	for {
+		e.mu.Lock()
+		n := len(e.buffer)
+		if n > e.opts.BatchSize {
+			n = e.opts.BatchSize
+		}
+		batch := e.buffer[:n:n]
+		e.buffer = e.buffer[n:]
+		e.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			if errors.Is(err, errRejected) {
+				logger.Logf(logger.LevelInfo, "perfexport: dropping %d lines %v", len(batch), err)
+				e.mu.Lock()
+				e.dropped += int64(len(batch))
+				e.mu.Unlock()
+				continue
+			}
+			logger.Logf(logger.LevelInfo, "perfexport: failed to send %d lines to %s, will retry: %v", len(batch), e.opts.Address, err)
+			e.requeue(batch)
+			return
+		}
+		logger.Logf(logger.LevelTrace, "perfexport: sent %d lines to %s", len(batch), e.opts.Address)
+	}
+}
+
+// requeue puts an unsent batch back in front of newer lines, dropping the oldest
+// lines if that takes the buffer over its limit
+func (e *Exporter) requeue(batch []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buffer = append(append([]string(nil), batch...), e.buffer...)
+	if over := len(e.buffer) - e.opts.BufferSize; over > 0 {
+		e.buffer = e.buffer[over:]
+		e.dropped += int64(over)
+	}
+}
+
+func (e *Exporter) send(lines []string) error {
+	switch e.opts.Protocol {
+	case ProtocolHTTP:
+		return e.sendHTTP(lines)
+	case ProtocolUDP:
+		return e.sendUDP(lines)
+	default:
+		return e.sendTCP(lines)
+	}
+}
+
+func (e *Exporter) sendTCP(lines []string) error {
+	conn, err := e.connection()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(e.opts.Timeout))
+	if _, err := io.WriteString(conn, strings.Join(lines, "\n")+"\n"); err != nil {
+		e.closeConnection()
+		return err
+	}
+	return nil
+}
+
+func (e *Exporter) sendUDP(lines []string) error {
+	conn, err := e.connection()
+	if err != nil {
+		return err
+	}
+	var packet bytes.Buffer
+	for i, line := range lines {
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+		last := i == len(lines)-1
+		if last || packet.Len()+len(lines[i+1])+1 > maxDatagramSize {
+			conn.SetWriteDeadline(time.Now().Add(e.opts.Timeout))
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				e.closeConnection()
+				return err
+			}
+			packet.Reset()
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) sendHTTP(lines []string) error {
+	body := strings.NewReader(strings.Join(lines, "\n") + "\n")
+	resp, err := e.client.Post(e.opts.Address, "text/plain; charset=utf-8", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	io.Copy(io.Discard, resp.Body)
+	err = fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	// Other 4xx responses (bad line protocol, bad credentials, unknown database) will
+	// not change on resend, so they must not hold up the lines queued behind them
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w by %s: %v", errRejected, e.opts.Address, err)
+	}
+	return err
+}
+
+// connection returns the open TCP/UDP connection, dialling it if needed
+func (e *Exporter) connection() (net.Conn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		return e.conn, nil
+	}
+	conn, err := net.DialTimeout(e.opts.Protocol, e.opts.Address, e.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+func (e *Exporter) closeConnection() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
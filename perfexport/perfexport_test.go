@@ -0,0 +1,119 @@
+package perfexport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nrdp_micro/check"
+)
+
+func TestInfluxLineSkipsNonFiniteValues(t *testing.T) {
+	result := check.Result{
+		HostName:    "web01",
+		ServiceName: "Load",
+		Output:      "OK|load=1.5;inf;nan;-inf;+Inf 'bad'=1;2;3;nan;inf",
+		Time:        1700000000,
+	}
+	lines := formatResult(FormatInflux, "nagios", &result, time.Now())
+	want := []string{
+		"nagios,host=web01,service=Load,label=load value=1.5 1700000000000000000",
+		"nagios,host=web01,service=Load,label=bad value=1,warn=2,crit=3 1700000000000000000",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// recordingEndpoint answers every request with the next status and records the bodies
+type recordingEndpoint struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (r *recordingEndpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	r.bodies = append(r.bodies, string(body))
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *recordingEndpoint) requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies...)
+}
+
+// newTestExporter builds an HTTP exporter to endpoint without starting its flush loop,
+// so the tests call flush themselves
+func newTestExporter(t *testing.T, endpoint http.Handler) *Exporter {
+	t.Helper()
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	return &Exporter{
+		opts: Options{
+			Format:     FormatInflux,
+			Protocol:   ProtocolHTTP,
+			Address:    server.URL,
+			Prefix:     "nagios",
+			BatchSize:  1,
+			BufferSize: 10,
+			Timeout:    time.Second,
+		},
+		client: server.Client(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func writeResult(t *testing.T, e *Exporter, label string) {
+	t.Helper()
+	result := check.Result{HostName: "web01", ServiceName: "Load", Output: "OK|" + label + "=1", Time: 1700000000}
+	if err := e.Write(context.Background(), []check.Result{result}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPClientErrorDropsBatch(t *testing.T) {
+	endpoint := &recordingEndpoint{statuses: []int{http.StatusBadRequest}}
+	e := newTestExporter(t, endpoint)
+
+	writeResult(t, e, "first")
+	writeResult(t, e, "second")
+	e.flush()
+
+	requests := endpoint.requests()
+	if len(requests) != 2 || !strings.Contains(requests[0], "label=first") || !strings.Contains(requests[1], "label=second") {
+		t.Fatalf("requests = %q, want the rejected first batch once and then the second", requests)
+	}
+	if e.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", e.Dropped())
+	}
+}
+
+func TestHTTPServerErrorRetriesBatch(t *testing.T) {
+	endpoint := &recordingEndpoint{statuses: []int{http.StatusServiceUnavailable}}
+	e := newTestExporter(t, endpoint)
+
+	writeResult(t, e, "first")
+	e.flush() // Fails and keeps the batch
+	e.flush()
+
+	requests := endpoint.requests()
+	if len(requests) != 2 || !strings.Contains(requests[1], "label=first") {
+		t.Fatalf("requests = %q, want the first batch sent twice", requests)
+	}
+	if e.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", e.Dropped())
+	}
+}
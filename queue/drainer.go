@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"nrdp_micro/logger"
+)
+
+// ErrDiscard can be wrapped by a HandlerFunc to drop a record that can never be handled
+var ErrDiscard = errors.New("discard record")
+
+// HandlerFunc delivers a single queued record
+type HandlerFunc func(ctx context.Context, payload []byte) error
+
+// Drainer feeds queued records to a handler in order, retrying failed records with
+// exponential backoff so nothing is lost while the destination is unavailable.
+type Drainer struct {
+	queue      *Queue
+	handle     HandlerFunc
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDrainer creates a drainer delivering records from q to handle
+func NewDrainer(q *Queue, handle HandlerFunc) *Drainer {
+	return &Drainer{
+		queue:      q,
+		handle:     handle,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+	}
+}
+
+// Start runs the drainer in a goroutine. Records left over from a previous run are replayed first.
+func (d *Drainer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run(ctx)
+	}()
+}
+
+// Stop stops the drainer and waits for the record in progress to finish
+func (d *Drainer) Stop() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *Drainer) run(ctx context.Context) {
+	backoff := d.minBackoff
+	for {
+		payload, next, ok, err := d.queue.Peek()
+		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			logger.Logf(logger.LevelInfo, "Queue read failed: %v", err)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			// Wait for new records; the periodic wake-up guards against a missed notification
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.queue.Notify():
+			case <-time.After(d.maxBackoff):
+			}
+			continue
+		}
+
+		if err := d.handle(ctx, payload); err != nil {
+			if !errors.Is(err, ErrDiscard) {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Logf(logger.LevelInfo, "Delivering queued record failed, retrying in %s: %v", backoff, err)
+				if !sleep(ctx, backoff) {
+					return
+				}
+				backoff *= 2
+				if backoff > d.maxBackoff {
+					backoff = d.maxBackoff
+				}
+				continue
+			}
+			logger.Logf(logger.LevelInfo, "Discarding queued record: %v", err)
+		}
+		backoff = d.minBackoff
+
+		if err := d.queue.Ack(next); err != nil {
+			logger.Logf(logger.LevelInfo, "Failed to acknowledge queued record: %v", err)
+		}
+	}
+}
+
+// sleep waits for the duration, returning false if ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,562 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"nrdp_micro/logger"
+)
+
+const (
+	// recordHeaderSize is the length and CRC32-C checksum preceding each payload
+	recordHeaderSize = 8
+	// maxRecordSize guards against reading garbage lengths from a damaged segment
+	maxRecordSize = 64 << 20
+
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+)
+
+var (
+	// ErrFull is returned by Append when the queue has reached its size limit
+	ErrFull = errors.New("queue is full")
+	// ErrClosed is returned when using a closed queue
+	ErrClosed = errors.New("queue is closed")
+
+	errCorrupt = errors.New("corrupt record")
+	crcTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Position identifies a record boundary in the queue
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+// Queue is a durable FIFO of opaque records stored in append-only segment files.
+// Every record is checksummed and fsynced before Append returns, and the read
+// position is persisted on Ack, so records survive a crash and are replayed on
+// the next Open. Delivery is at-least-once: a record may be seen again if the
+// process stops between handling it and acknowledging it.
+type Queue struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu          sync.Mutex
+	segments    []uint64 // ids of existing segments in ascending order
+	size        int64    // total bytes across all segments
+	writeFile   *os.File
+	writeOffset int64
+	readPos     Position
+	readFile    *os.File
+	readSegment uint64
+	closed      bool
+
+	notify chan struct{}
+}
+
+// Open opens or creates the queue in dir. Segments are rotated after segmentSize bytes,
+// and Append fails with ErrFull once maxSize bytes of unacknowledged records are waiting
+// (0 disables the limit).
+// A record torn by a crash at the end of the last segment is discarded; when intact
+// records follow the damage, the segment is kept and appending starts a new one.
+func Open(dir string, segmentSize, maxSize int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory %s: %w", dir, err)
+	}
+
+	q := &Queue{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		notify:      make(chan struct{}, 1),
+	}
+
+	if err := q.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := q.loadCursor(); err != nil {
+		return nil, err
+	}
+	if err := q.openWriteSegment(); err != nil {
+		return nil, err
+	}
+
+	logger.Logf(logger.LevelInfo, "Queue opened at %s (%d segments, %d bytes, read position %d:%d)",
+		dir, len(q.segments), q.size, q.readPos.Segment, q.readPos.Offset)
+	return q, nil
+}
+
+// Append durably adds a record to the end of the queue
+func (q *Queue) Append(payload []byte) error {
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds maximum of %d", len(payload), maxRecordSize)
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.maxSize > 0 && q.pendingLocked()+int64(len(record)) > q.maxSize {
+		return ErrFull
+	}
+	if q.writeOffset > 0 && q.writeOffset+int64(len(record)) > q.segmentSize {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.writeFile.WriteAt(record, q.writeOffset); err != nil {
+		q.discardPartialLocked()
+		return fmt.Errorf("failed to append to queue segment %s: %w", q.writeFile.Name(), err)
+	}
+	if err := q.writeFile.Sync(); err != nil {
+		q.discardPartialLocked()
+		return fmt.Errorf("failed to sync queue segment %s: %w", q.writeFile.Name(), err)
+	}
+	q.writeOffset += int64(len(record))
+	q.size += int64(len(record))
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the record at the read position without consuming it, along with the
+// position following it to pass to Ack. ok is false when the queue is empty.
+// Damaged records are skipped: reading resumes at the next intact record of the segment,
+// or at the next segment when there is none.
+func (q *Queue) Peek() (payload []byte, next Position, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, Position{}, false, ErrClosed
+	}
+
+	for {
+		current := q.readPos.Segment == q.currentSegment()
+		// Bytes past the write offset belong to no committed record
+		if current && q.readPos.Offset >= q.writeOffset {
+			return nil, Position{}, false, nil
+		}
+		payload, offset, err := q.readLocked(q.readPos)
+		switch {
+		case err == nil:
+			return payload, Position{Segment: q.readPos.Segment, Offset: offset}, true, nil
+		case errors.Is(err, io.EOF) && current:
+			return nil, Position{}, false, nil
+		case errors.Is(err, io.EOF):
+			// Move on to the next segment
+			q.readPos = Position{Segment: q.nextSegment(q.readPos.Segment)}
+		case errors.Is(err, errCorrupt):
+			if err := q.skipDamagedLocked(current); err != nil {
+				return nil, Position{}, false, err
+			}
+		default:
+			return nil, Position{}, false, err
+		}
+	}
+}
+
+// skipDamagedLocked moves the read position past the damaged record at it, to the next
+// intact record of the segment or else to the next segment. The write segment is rotated
+// first when it is the damaged one, so new records do not land behind the damage.
+func (q *Queue) skipDamagedLocked(current bool) error {
+	pos := q.readPos
+	end := q.writeOffset
+	if !current {
+		info, err := q.readFile.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat queue segment %d: %w", pos.Segment, err)
+		}
+		end = info.Size()
+	}
+	next, found, err := findRecord(q.readFile, pos.Offset+1, end)
+	if err != nil {
+		return fmt.Errorf("failed to read queue segment %d: %w", pos.Segment, err)
+	}
+	if found {
+		logger.Logf(logger.LevelInfo, "Queue segment %d is damaged at offset %d, skipping %d bytes to the next intact record", pos.Segment, pos.Offset, next-pos.Offset)
+		q.readPos.Offset = next
+		return nil
+	}
+	logger.Logf(logger.LevelInfo, "Queue segment %d is damaged at offset %d, skipping the rest of it", pos.Segment, pos.Offset)
+	if current {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	q.readPos = Position{Segment: q.nextSegment(pos.Segment)}
+	return nil
+}
+
+// discardPartialLocked removes what a failed append may have left after the write offset.
+// If the segment cannot be truncated, appending continues in a new segment instead.
+func (q *Queue) discardPartialLocked() {
+	err := q.writeFile.Truncate(q.writeOffset)
+	if err == nil {
+		return
+	}
+	logger.Logf(logger.LevelInfo, "Failed to truncate queue segment %s after a failed append: %v", q.writeFile.Name(), err)
+	// The leftover bytes stay in the segment until it is removed, which subtracts its full size
+	if info, err := q.writeFile.Stat(); err == nil && info.Size() > q.writeOffset {
+		q.size += info.Size() - q.writeOffset
+	}
+	if err := q.rotateLocked(); err != nil {
+		logger.Logf(logger.LevelInfo, "Failed to rotate queue segment: %v", err)
+	}
+}
+
+// Ack marks every record before pos as consumed, persists the read position and
+// removes segments that are no longer needed.
+func (q *Queue) Ack(pos Position) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	q.readPos = pos
+	if err := q.saveCursorLocked(); err != nil {
+		return err
+	}
+	q.removeConsumedLocked()
+	return nil
+}
+
+// Notify returns a channel that receives a value after records are appended
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Stats returns the number of segments and bytes held by the queue
+func (q *Queue) Stats() (segments int, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.segments), q.size
+}
+
+// Close closes the segment files. Unacknowledged records are kept for the next Open.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	return q.writeFile.Close()
+}
+
+// loadSegments lists the existing segment files
+func (q *Queue) loadSegments() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory %s: %w", q.dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat queue segment %s: %w", name, err)
+		}
+		q.segments = append(q.segments, id)
+		q.size += info.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	return nil
+}
+
+// loadCursor restores the persisted read position
+func (q *Queue) loadCursor() error {
+	if len(q.segments) > 0 {
+		q.readPos = Position{Segment: q.segments[0]}
+	} else {
+		q.readPos = Position{Segment: 1}
+	}
+
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read queue cursor: %w", err)
+	}
+
+	var pos Position
+	if _, err := fmt.Sscanf(string(data), "%d %d", &pos.Segment, &pos.Offset); err != nil {
+		logger.Logf(logger.LevelInfo, "Queue cursor is unreadable (%v), replaying from the oldest segment", err)
+		return nil
+	}
+	// A cursor pointing before the oldest segment means those segments were already removed
+	if pos.Segment >= q.readPos.Segment {
+		q.readPos = pos
+	}
+	return nil
+}
+
+// openWriteSegment opens the newest segment for appending, discarding a torn record at its end
+func (q *Queue) openWriteSegment() error {
+	if len(q.segments) == 0 {
+		id := q.readPos.Segment
+		f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to create queue segment: %w", err)
+		}
+		q.segments = append(q.segments, id)
+		q.writeFile = f
+		q.writeOffset = 0
+		return syncDir(q.dir)
+	}
+
+	id := q.segments[len(q.segments)-1]
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open queue segment %d: %w", id, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat queue segment %d: %w", id, err)
+	}
+
+	// Find the end of the last complete record
+	var offset int64
+	for {
+		_, next, err := readRecord(f, offset)
+		if err != nil {
+			break
+		}
+		offset = next
+	}
+
+	if offset < info.Size() {
+		_, intactAfter, err := findRecord(f, offset+1, info.Size())
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read queue segment %d: %w", id, err)
+		}
+		if intactAfter {
+			// Damage in the middle: keep the records behind it for Peek to find and
+			// append to a new segment instead
+			logger.Logf(logger.LevelInfo, "Queue segment %d is damaged at offset %d, starting a new segment", id, offset)
+			q.writeFile = f
+			q.writeOffset = info.Size()
+			return q.rotateLocked()
+		}
+		logger.Logf(logger.LevelInfo, "Queue segment %d has %d bytes of incomplete data at its end, truncating", id, info.Size()-offset)
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to truncate queue segment %d: %w", id, err)
+		}
+		q.size -= info.Size() - offset
+	}
+	if q.readPos.Segment == id && q.readPos.Offset > offset {
+		q.readPos.Offset = offset
+	}
+
+	q.writeFile = f
+	q.writeOffset = offset
+	return nil
+}
+
+// rotateLocked starts a new segment for appending
+func (q *Queue) rotateLocked() error {
+	id := q.currentSegment() + 1
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment %d: %w", id, err)
+	}
+	if err := syncDir(q.dir); err != nil {
+		f.Close()
+		return err
+	}
+	q.writeFile.Close()
+	q.writeFile = f
+	q.writeOffset = 0
+	q.segments = append(q.segments, id)
+	logger.Logf(logger.LevelDebug, "Queue rotated to segment %d", id)
+	return nil
+}
+
+// readLocked reads the record at pos, returning it and the offset following it
+func (q *Queue) readLocked(pos Position) ([]byte, int64, error) {
+	if q.readFile == nil || q.readSegment != pos.Segment {
+		if q.readFile != nil {
+			q.readFile.Close()
+			q.readFile = nil
+		}
+		f, err := os.Open(q.segmentPath(pos.Segment))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, io.EOF
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open queue segment %d: %w", pos.Segment, err)
+		}
+		q.readFile = f
+		q.readSegment = pos.Segment
+	}
+	return readRecord(q.readFile, pos.Offset)
+}
+
+// saveCursorLocked atomically persists the read position
+func (q *Queue) saveCursorLocked() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to write queue cursor: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", q.readPos.Segment, q.readPos.Offset); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write queue cursor: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync queue cursor: %w", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace queue cursor: %w", err)
+	}
+	return nil
+}
+
+// removeConsumedLocked deletes segments that lie entirely before the read position
+func (q *Queue) removeConsumedLocked() {
+	for len(q.segments) > 1 && q.segments[0] < q.readPos.Segment {
+		id := q.segments[0]
+		path := q.segmentPath(id)
+		if info, err := os.Stat(path); err == nil {
+			q.size -= info.Size()
+		}
+		if q.readFile != nil && q.readSegment == id {
+			q.readFile.Close()
+			q.readFile = nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Logf(logger.LevelInfo, "Failed to remove consumed queue segment %s: %v", path, err)
+			return
+		}
+		q.segments = q.segments[1:]
+		logger.Logf(logger.LevelDebug, "Removed consumed queue segment %d", id)
+	}
+}
+
+// pendingLocked returns the bytes of records not yet acknowledged. Ack removes the segments
+// before the read position, so only the consumed part of the read segment is subtracted.
+func (q *Queue) pendingLocked() int64 {
+	return q.size - q.readPos.Offset
+}
+
+func (q *Queue) currentSegment() uint64 {
+	return q.segments[len(q.segments)-1]
+}
+
+// nextSegment returns the id of the first existing segment after id
+func (q *Queue) nextSegment(id uint64) uint64 {
+	for _, s := range q.segments {
+		if s > id {
+			return s
+		}
+	}
+	return q.currentSegment()
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// readRecord reads and verifies the record at offset, returning it and the following offset.
+// It returns io.EOF at the clean end of the segment and errCorrupt for torn or damaged records.
+func readRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	var header [recordHeaderSize]byte
+	n, err := f.ReadAt(header[:], offset)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil, 0, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, 0, errCorrupt
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, 0, errCorrupt
+	}
+	payload := make([]byte, length)
+	if n, _ := f.ReadAt(payload, offset+recordHeaderSize); n < int(length) {
+		return nil, 0, errCorrupt
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	return payload, offset + recordHeaderSize + int64(length), nil
+}
+
+// findRecord returns the offset of the first intact record starting between from and end,
+// for resuming after a damaged one. A match is a record whose length fits before end and
+// whose checksum matches, which random bytes pass with a probability of about 2^-32.
+func findRecord(f *os.File, from, end int64) (int64, bool, error) {
+	if end-from < recordHeaderSize {
+		return 0, false, nil
+	}
+	data := make([]byte, end-from)
+	if _, err := f.ReadAt(data, from); err != nil && !errors.Is(err, io.EOF) {
+		return 0, false, err
+	}
+	for i := 0; i+recordHeaderSize <= len(data); i++ {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if length > maxRecordSize || i+recordHeaderSize+length > len(data) {
+			continue
+		}
+		payload := data[i+recordHeaderSize : i+recordHeaderSize+length]
+		if crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(data[i+4:i+8]) {
+			return from + int64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// syncDir fsyncs a directory so newly created files survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openQueue(t *testing.T, dir string, segmentSize, maxSize int64) *Queue {
+	t.Helper()
+	q, err := Open(dir, segmentSize, maxSize)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return q
+}
+
+// consume peeks and acknowledges the next record, failing if there is none
+func consume(t *testing.T, q *Queue) []byte {
+	t.Helper()
+	payload, next, ok, err := q.Peek()
+	if err != nil || !ok {
+		t.Fatalf("Peek: ok=%v err=%v", ok, err)
+	}
+	if err := q.Ack(next); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	return payload
+}
+
+func assertEmpty(t *testing.T, q *Queue) {
+	t.Helper()
+	if payload, _, ok, err := q.Peek(); ok || err != nil {
+		t.Fatalf("expected an empty queue, got %q ok=%v err=%v", payload, ok, err)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := openQueue(t, t.TempDir(), 64, 0) // Small segments so records span several of them
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if got, want := string(consume(t, q)), fmt.Sprintf("record %d", i); got != want {
+			t.Fatalf("record %d = %q, want %q", i, got, want)
+		}
+	}
+	assertEmpty(t, q)
+	if segments, _ := q.Stats(); segments != 1 {
+		t.Errorf("%d segments left after consuming everything, want 1", segments)
+	}
+}
+
+func TestQueueMaxSizeCountsOnlyUnacknowledged(t *testing.T) {
+	q := openQueue(t, t.TempDir(), 1<<20, 1000)
+	defer q.Close()
+
+	payload := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 100; i++ {
+		if err := q.Append(payload); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+		consume(t, q)
+	}
+
+	for i := 0; ; i++ {
+		err := q.Append(payload)
+		if errors.Is(err, ErrFull) {
+			if i != 1000/(recordHeaderSize+100) {
+				t.Errorf("ErrFull after %d records, want %d", i, 1000/(recordHeaderSize+100))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	consume(t, q)
+	if err := q.Append(payload); err != nil {
+		t.Errorf("Append after Ack: %v", err)
+	}
+}
+
+func TestQueueReplaysUnacknowledgedAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 64, 0)
+	for i := 0; i < 5; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume(t, q)
+	consume(t, q)
+	// Seen but not acknowledged, as when the process dies while delivering it
+	if _, _, ok, err := q.Peek(); !ok || err != nil {
+		t.Fatalf("Peek: ok=%v err=%v", ok, err)
+	}
+	q.Close()
+
+	q = openQueue(t, dir, 64, 0)
+	defer q.Close()
+	for i := 2; i < 5; i++ {
+		if got, want := string(consume(t, q)), fmt.Sprintf("record %d", i); got != want {
+			t.Fatalf("replayed %q, want %q", got, want)
+		}
+	}
+	assertEmpty(t, q)
+}
+
+// lastSegment returns the path of the newest segment file in dir
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(matches) == 0 {
+		t.Fatalf("no segments in %s: %v", dir, err)
+	}
+	return matches[len(matches)-1]
+}
+
+func TestQueueTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 1<<20, 0)
+	for _, payload := range []string{"first", "second"} {
+		if err := q.Append([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	// Cut the second record short, as a crash in the middle of a write would
+	path := lastSegment(t, dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, 1<<20, 0)
+	defer q.Close()
+	if got := string(consume(t, q)); got != "first" {
+		t.Fatalf("got %q, want first", got)
+	}
+	assertEmpty(t, q)
+
+	// New records go after the last complete one
+	if err := q.Append([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(consume(t, q)); got != "third" {
+		t.Fatalf("got %q, want third", got)
+	}
+}
+
+func TestQueueSkipsCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 40, 0) // One 24-byte record per segment
+	for i := 0; i < 3; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("record-%09d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	// Flip a payload byte in the first segment so its checksum no longer matches
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(matches) != 3 {
+		t.Fatalf("%d segments, want 3", len(matches))
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(matches[0], data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, 40, 0)
+	defer q.Close()
+	for i := 1; i < 3; i++ {
+		if got, want := string(consume(t, q)), fmt.Sprintf("record-%09d", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	assertEmpty(t, q)
+}
+
+// damageRecord flips a payload byte of the record at offset in the segment at path
+func damageRecord(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset+recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueSkipsDamagedRecordInWriteSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 1<<20, 0)
+	defer q.Close()
+	for _, payload := range []string{"first", "second", "third"} {
+		if err := q.Append([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	damageRecord(t, lastSegment(t, dir), recordHeaderSize+int64(len("first")))
+
+	for _, want := range []string{"first", "third"} {
+		if got := string(consume(t, q)); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	assertEmpty(t, q)
+}
+
+func TestQueueRotatesAwayFromDamagedWriteSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 1<<20, 0)
+	defer q.Close()
+	for _, payload := range []string{"first", "second"} {
+		if err := q.Append([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	damageRecord(t, lastSegment(t, dir), recordHeaderSize+int64(len("first")))
+
+	if got := string(consume(t, q)); got != "first" {
+		t.Fatalf("got %q, want first", got)
+	}
+	assertEmpty(t, q)
+
+	// Records appended after the damage are still delivered
+	if err := q.Append([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(consume(t, q)); got != "third" {
+		t.Fatalf("got %q, want third", got)
+	}
+	if segments, _ := q.Stats(); segments != 1 {
+		t.Errorf("%d segments left after consuming everything, want 1", segments)
+	}
+}
+
+func TestQueueKeepsRecordsAfterDamageOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 1<<20, 0)
+	for _, payload := range []string{"first", "second", "third"} {
+		if err := q.Append([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+	damaged := lastSegment(t, dir)
+	damageRecord(t, damaged, recordHeaderSize+int64(len("first")))
+
+	q = openQueue(t, dir, 1<<20, 0)
+	defer q.Close()
+	if lastSegment(t, dir) == damaged {
+		t.Error("appending continues in the damaged segment")
+	}
+	if err := q.Append([]byte("fourth")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "third", "fourth"} {
+		if got := string(consume(t, q)); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	assertEmpty(t, q)
+}
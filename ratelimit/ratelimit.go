@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// idleSweepInterval is how often buckets that have refilled completely are forgotten
+	idleSweepInterval = time.Minute
+	// limitedRetention is how long the bucket of a refused key is kept for Limited, even
+	// after it has refilled
+	limitedRetention = 5 * time.Minute
+)
+
+// Limiter is a set of token buckets, one per key (client IP, token, ...), each refilling
+// at rate tokens per second up to burst.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updated   time.Time
+	limitedAt time.Time // Last time an event for this key was refused
+}
+
+// NewLimiter creates a limiter allowing rate events per second per key with the given burst.
+// A burst below 1 is raised to the rate, rounded up.
+func NewLimiter(rate float64, burst int) *Limiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Limiter{rate: rate, burst: b, buckets: make(map[string]*bucket)}
+}
+
+// AllowN reports whether n events for key are allowed at now, taking them from the bucket
+// if so. When they are not, it returns how long until they would be; n larger than the
+// burst is never allowed and reports the time to refill the whole bucket.
+func (l *Limiter) AllowN(key string, n int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.updated = now
+	}
+
+	need := float64(n)
+	if need <= b.tokens {
+		b.tokens -= need
+		return true, 0
+	}
+	b.limitedAt = now
+	missing := math.Min(need, l.burst) - b.tokens
+	return false, time.Duration(missing / l.rate * float64(time.Second))
+}
+
+// Refund returns n events taken by AllowN for key, when the request they were taken for
+// was refused by another limit after all
+func (l *Limiter) Refund(key string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+float64(n))
+	}
+}
+
+// Burst returns the most events a single AllowN call can be granted
+func (l *Limiter) Burst() int {
+	return int(l.burst)
+}
+
+// Limited returns the number of keys that had events refused since the given time,
+// which may be up to limitedRetention ago
+func (l *Limiter) Limited(since time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, b := range l.buckets {
+		if b.limitedAt.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket is identical,
+// unless Limited still has to count them
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.limitedAt) < limitedRetention {
+			continue
+		}
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func TestLimiterAllowN(t *testing.T) {
+	l := NewLimiter(2, 4)
+	if ok, _ := l.AllowN("a", 4, start); !ok {
+		t.Fatal("burst refused")
+	}
+	ok, wait := l.AllowN("a", 1, start)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("empty bucket = %v, wait %s; want refused, wait 500ms", ok, wait)
+	}
+	if ok, _ := l.AllowN("b", 1, start); !ok {
+		t.Error("other key refused")
+	}
+	if ok, _ := l.AllowN("a", 1, start.Add(500*time.Millisecond)); !ok {
+		t.Error("refilled bucket refused")
+	}
+	if ok, _ := l.AllowN("a", 5, start.Add(time.Hour)); ok {
+		t.Error("more than the burst allowed")
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	l := NewLimiter(1, 2)
+	l.AllowN("a", 2, start)
+	l.Refund("a", 1)
+	if ok, _ := l.AllowN("a", 1, start); !ok {
+		t.Error("refunded event refused")
+	}
+	if ok, _ := l.AllowN("a", 1, start); ok {
+		t.Error("more than refunded allowed")
+	}
+	l.Refund("a", 10)
+	if ok, _ := l.AllowN("a", 3, start); ok {
+		t.Error("refund raised the bucket above the burst")
+	}
+}
+
+func TestLimiterLimitedSurvivesSweep(t *testing.T) {
+	l := NewLimiter(10, 1)
+	l.AllowN("a", 1, start)
+	l.AllowN("a", 1, start) // Refused
+	l.AllowN("idle", 1, start)
+
+	// A sweep after the bucket has refilled must not forget that it was limited
+	now := start.Add(idleSweepInterval + time.Second)
+	l.AllowN("b", 1, now)
+	if got := l.Limited(now.Add(-2 * idleSweepInterval)); got != 1 {
+		t.Errorf("Limited = %d after a sweep, want 1", got)
+	}
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket that was never limited survived the sweep")
+	}
+
+	now = start.Add(limitedRetention + idleSweepInterval)
+	l.AllowN("b", 1, now)
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("limited bucket kept past limitedRetention")
+	}
+}
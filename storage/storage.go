@@ -48,6 +48,12 @@ func (m *Manager) CheckSpace() error {
 
 // CheckFiles checks if there are too many files in the directory
 func (m *Manager) CheckFiles() (bool, error) {
+	return m.CheckRoom(1)
+}
+
+// CheckRoom checks if the directory is too full to take the given number of check result
+// files, each written with its .ok marker, as if CheckFiles were called before each of them
+func (m *Manager) CheckRoom(files int) (bool, error) {
 	dir, err := os.Open(m.outputDir)
 	if err != nil {
 		return false, fmt.Errorf("failed to read directory: %v", err)
@@ -67,8 +73,8 @@ func (m *Manager) CheckFiles() (bool, error) {
 		}
 	}
 
-	if count >= m.maxFiles {
-		logger.Logf(logger.LevelDebug, "storage: too many files: %d (max: %d)", count, m.maxFiles)
+	if files > 0 && count+2*(files-1) >= m.maxFiles {
+		logger.Logf(logger.LevelDebug, "storage: too many files: %d, %d more needed (max: %d)", count, 2*files, m.maxFiles)
 		return true, nil
 	}
 
@@ -0,0 +1,182 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"nrdp_micro/logger"
+)
+
+// Client certificate modes
+const (
+	ClientAuthRequire  = "require"  // Clients must present a certificate signed by the client CA
+	ClientAuthOptional = "optional" // Certificates are verified when presented
+)
+
+// Options configures the server TLS settings
+type Options struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string // "1.2" or "1.3"
+	ClientCAFile string // PEM bundle of CAs accepted for client certificates, empty disables mTLS
+	ClientAuth   string // ClientAuthRequire or ClientAuthOptional
+}
+
+// ParseVersion converts "1.2" or "1.3" to the crypto/tls constant
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (must be 1.2 or 1.3)", version)
+	}
+}
+
+// NewServerConfig builds the server TLS configuration. The returned reloader serves the
+// certificate; start its Watch to pick up renewed files and stop it on shutdown.
+func NewServerConfig(opts Options) (*tls.Config, *CertReloader, error) {
+	minVersion, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reloader, err := NewCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA file %s", opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if opts.ClientAuth == ClientAuthOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return config, reloader, nil
+}
+
+// CertReloader serves a certificate/key pair and reloads it when the files change,
+// so renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the two files when last loaded
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewCertReloader loads the certificate pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{})}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks the files every interval and reloads them when they changed.
+// A pair that fails to load is logged and the previous certificate stays in use.
+func (r *CertReloader) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			modTime, err := r.latestModTime()
+			if err != nil {
+				logger.Logf(logger.LevelInfo, "Failed to check TLS certificate files: %v", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := !modTime.Equal(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.load(); err != nil {
+				logger.Logf(logger.LevelInfo, "Failed to reload TLS certificate, keeping the current one: %v", err)
+				continue
+			}
+			logger.Logf(logger.LevelInfo, "Reloaded TLS certificate from %s", r.certFile)
+		}
+	}()
+}
+
+// Stop stops watching the certificate files
+func (r *CertReloader) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+func (r *CertReloader) load() error {
+	// Read the modification time first so a change during loading is picked up next time
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("failed to load TLS certificate: no certificate found")
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
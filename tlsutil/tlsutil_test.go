@@ -0,0 +1,176 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name and its key into dir, and returns
+// the DER of the certificate
+func writeCert(t *testing.T, dir, name string, modTime time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return der
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.version)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseVersion(%q) = %v, %v", tt.version, got, err)
+		}
+	}
+}
+
+func TestNewServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "nrdp.example.com", time.Now())
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caDir := t.TempDir()
+	writeCert(t, caDir, "client-ca", time.Now())
+	ca := filepath.Join(caDir, "cert.pem")
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		opts           Options
+		wantClientAuth tls.ClientAuthType
+		wantErr        bool
+	}{
+		{"server only", Options{CertFile: cert, KeyFile: key, MinVersion: "1.2"}, tls.NoClientCert, false},
+		{"client certificate required", Options{CertFile: cert, KeyFile: key, MinVersion: "1.3", ClientCAFile: ca, ClientAuth: ClientAuthRequire}, tls.RequireAndVerifyClientCert, false},
+		{"client certificate optional", Options{CertFile: cert, KeyFile: key, MinVersion: "1.2", ClientCAFile: ca, ClientAuth: ClientAuthOptional}, tls.VerifyClientCertIfGiven, false},
+		{"bad version", Options{CertFile: cert, KeyFile: key, MinVersion: "1.0"}, 0, true},
+		{"missing key", Options{CertFile: cert, KeyFile: filepath.Join(dir, "missing.pem"), MinVersion: "1.2"}, 0, true},
+		{"missing client CA", Options{CertFile: cert, KeyFile: key, MinVersion: "1.2", ClientCAFile: filepath.Join(dir, "missing.pem")}, 0, true},
+		{"client CA without certificates", Options{CertFile: cert, KeyFile: key, MinVersion: "1.2", ClientCAFile: notPEM}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, reloader, err := NewServerConfig(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewServerConfig succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewServerConfig: %v", err)
+			}
+			defer reloader.Stop()
+			if config.ClientAuth != tt.wantClientAuth {
+				t.Errorf("ClientAuth = %v, want %v", config.ClientAuth, tt.wantClientAuth)
+			}
+			if (config.ClientCAs != nil) != (tt.opts.ClientCAFile != "") {
+				t.Errorf("ClientCAs = %v with client CA file %q", config.ClientCAs, tt.opts.ClientCAFile)
+			}
+			if got, err := config.GetCertificate(nil); err != nil || got == nil {
+				t.Errorf("GetCertificate = %v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCert(t, dir, "first.example.com", time.Now().Add(-time.Hour))
+	r, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	defer r.Stop()
+	r.Watch(5 * time.Millisecond)
+
+	current := func() []byte {
+		cert, _ := r.GetCertificate(nil)
+		return cert.Certificate[0]
+	}
+	waitFor := func(want []byte) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !bytes.Equal(current(), want) {
+			if time.Now().After(deadline) {
+				t.Fatal("renewed certificate was not picked up")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if !bytes.Equal(current(), first) {
+		t.Fatal("GetCertificate does not serve the loaded certificate")
+	}
+
+	second := writeCert(t, dir, "second.example.com", time.Now().Add(-30*time.Minute))
+	waitFor(second)
+
+	// A broken renewal keeps the current certificate in use
+	broken := time.Now()
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), []byte("truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "key.pem"), broken, broken)
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(current(), second) {
+		t.Fatal("certificate changed after a broken renewal")
+	}
+
+	// Once the renewal is complete it is picked up
+	third := writeCert(t, dir, "third.example.com", broken.Add(time.Minute))
+	waitFor(third)
+}